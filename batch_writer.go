@@ -0,0 +1,114 @@
+package listenrain
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"time"
+)
+
+// batchWriter drains up to MaxBatchSize payloads from the queue and
+// flushes them with a single vectored write, instead of one or more
+// syscalls per payload.
+type batchWriter struct {
+	edP      BatchEnDecPacket
+	q        BatchPopper
+	latency  time.Duration
+	payloads [][]byte
+	n        int
+	bufs     net.Buffers
+	// called on each payload before it's framed, the payload is skipped if it returns false
+	prepare func(payload []byte) bool
+}
+
+// return nil when the batching is disabled or not supported by
+// the EnDecPacket or the Queue, then payload is sent one by one
+func newBatchWriter(pt *protocolType, q Queue) *batchWriter {
+	if pt.MaxBatchSize <= 1 {
+		return nil
+	}
+
+	edP, ok := pt.EdP.(BatchEnDecPacket)
+	if !ok {
+		return nil
+	}
+
+	bq, ok := q.(BatchPopper)
+	if !ok {
+		return nil
+	}
+
+	return &batchWriter{
+		edP:      edP,
+		q:        bq,
+		latency:  pt.BatchLatency,
+		payloads: make([][]byte, pt.MaxBatchSize),
+		bufs:     make(net.Buffers, 0, 2*pt.MaxBatchSize),
+	}
+}
+
+// pop the next batch, unless the last one failed to flush and is still pending
+func (b *batchWriter) fill() int {
+	if b.n == 0 {
+		b.n = b.q.PopBatch(b.payloads, b.latency)
+	}
+	return b.n
+}
+
+// append the frame of payload by edp, the framing which can't batch is
+// encoded into one buffer, for the wrappers of another EnDecPacket
+func appendPacket(edp EnDecPacket, bufs net.Buffers, payload []byte) (net.Buffers, error) {
+	if bedp, ok := edp.(BatchEnDecPacket); ok {
+		return bedp.AppendPacket(bufs, payload)
+	}
+
+	var w bytes.Buffer
+	err := edp.EncodePacket(&w, payload)
+	if err != nil {
+		return bufs, err
+	}
+	return append(bufs, w.Bytes()), nil
+}
+
+// net.Buffers writes by writev only to the connections of the net
+// package, the Channel wrapping one hides it
+func batchWriterOf(w io.Writer) io.Writer {
+	if nc, ok := w.(NetConnChannel); ok {
+		if c := nc.NetConn(); c != nil {
+			return c
+		}
+	}
+	return w
+}
+
+func (b *batchWriter) flush(w io.Writer) error {
+	var err error
+	bufs := b.bufs[:0]
+	for i := 0; i < b.n; i++ {
+		if b.prepare != nil && !b.prepare(b.payloads[i]) {
+			continue
+		}
+
+		bufs, err = b.edP.AppendPacket(bufs, b.payloads[i])
+		if err = dropUnencodable(err); err != nil {
+			return err
+		}
+	}
+
+	// WriteTo consumes the buffers, so build them from payloads again on retry
+	used := bufs
+	b.bufs = bufs[:0]
+	_, err = bufs.WriteTo(batchWriterOf(w))
+	for i := range used {
+		used[i] = nil // help gc
+	}
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < b.n; i++ {
+		b.payloads[i] = nil // help gc
+	}
+	b.n = 0
+	return nil
+}
@@ -0,0 +1,172 @@
+package listenrain
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// counts the Write calls, which net.Buffers falls back to per buffer
+type countingChannel struct {
+	*TcpChannel
+	writes int
+}
+
+func (c *countingChannel) Write(b []byte) (int, error) {
+	c.writes++
+	return c.TcpChannel.Write(b)
+}
+
+// counts the Write calls, without the net.Conn behind it
+type plainChannel struct {
+	Channel
+	writes int
+}
+
+func (c *plainChannel) Write(b []byte) (int, error) {
+	c.writes++
+	return c.Channel.Write(b)
+}
+
+func testTcpPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err = ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func testFlushBatch(t *testing.T, ch Channel, peer net.Conn, n int) {
+	t.Helper()
+	edp := &DefaultEnDecPacket{}
+	q := NewDefaultQueue(n)
+	bw := newBatchWriter(&protocolType{EdP: edp, MaxBatchSize: n}, q)
+	for i := 0; i < n; i++ {
+		q.Push([]byte(fmt.Sprintf("payload-%d", i)))
+	}
+
+	if got := bw.fill(); got != n {
+		t.Fatalf("expect a batch of %d, got %d", n, got)
+	}
+
+	if err := bw.flush(ch); err != nil {
+		t.Fatal(err)
+	}
+
+	rd := bufio.NewReader(peer)
+	for i := 0; i < n; i++ {
+		p, err := edp.DecodePacket(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(p) != fmt.Sprintf("payload-%d", i) {
+			t.Fatalf("unexpected payload %s", p)
+		}
+	}
+}
+
+// the batch goes to the *net.TCPConn as a whole, which writes it by one
+// writev, no Write of the Channel is called per buffer
+func TestBatchWriterSingleWrite(t *testing.T) {
+	client, server := testTcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	ch := &countingChannel{TcpChannel: &TcpChannel{client}}
+	if _, ok := batchWriterOf(ch).(*net.TCPConn); !ok {
+		t.Fatalf("expect the batch written to *net.TCPConn, got %T", batchWriterOf(ch))
+	}
+
+	testFlushBatch(t, ch, server, 8)
+	if ch.writes != 0 {
+		t.Fatalf("expect one vectored write, got %d writes of the channel", ch.writes)
+	}
+}
+
+// without the net.Conn, net.Buffers writes the header and the body of each payload
+func TestBatchWriterFallback(t *testing.T) {
+	client, server := testTcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	ch := &plainChannel{Channel: &TcpChannel{client}}
+	testFlushBatch(t, ch, server, 8)
+	if ch.writes != 16 {
+		t.Fatalf("expect 16 writes, got %d", ch.writes)
+	}
+}
+
+// the payloads are batched end to end
+func TestBatchSendEcho(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	batch := func(pt *protocolType) {
+		pt.Multiplex = true
+		pt.MaxBatchSize = 16
+	}
+	key := testServer(t, testEchoRouter, batch)
+	ptyp := testClient(lr, batch)
+
+	results := make(chan error, 64)
+	for i := 0; i < 64; i++ {
+		go func(i int) {
+			msg := fmt.Sprintf("m:%d", i)
+			v, err := lr.SyncSend(ptyp, key, msg)
+			if err == nil && v != msg {
+				err = fmt.Errorf("expect %s, got %v", msg, v)
+			}
+			results <- err
+		}(i)
+	}
+
+	for i := 0; i < 64; i++ {
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAppendPacket(t *testing.T) {
+	for _, edp := range []EnDecPacket{&DefaultEnDecPacket{}, encodeOnlyEnDecPacket{&DefaultEnDecPacket{}}} {
+		bufs, err := appendPacket(edp, net.Buffers{[]byte("x")}, []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if _, err := bufs.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if buf.Next(1)[0] != 'x' {
+			t.Fatalf("%T, the buffers appended to are lost", edp)
+		}
+
+		p, err := edp.DecodePacket(&buf)
+		if err != nil || string(p) != "hello" {
+			t.Fatalf("%T, unexpected payload %q, %v", edp, p, err)
+		}
+	}
+
+	small := &DefaultEnDecPacket{MaxPacketSize: 4}
+	for _, edp := range []EnDecPacket{small, encodeOnlyEnDecPacket{small}} {
+		if _, err := appendPacket(edp, nil, []byte("hello")); !errors.Is(err, ErrPacketTooLarge) {
+			t.Fatalf("%T, expect ErrPacketTooLarge, got %v", edp, err)
+		}
+	}
+}
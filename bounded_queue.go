@@ -0,0 +1,259 @@
+package listenrain
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_QUEUE_MAX_BYTES = 1 << 26 // 64MiB
+)
+
+var (
+	ErrQueueClosed = errors.New("queue is closed")
+)
+
+// What to do when the payload doesn't fit in the BoundedQueue
+type OverflowPolicy uint8
+
+const (
+	// Push/PushContext wait for room
+	OVERFLOW_BLOCK OverflowPolicy = iota
+	// Push drops the payload, PushContext returns ErrQueueFull
+	OVERFLOW_REJECT
+	// evict the oldest payloads to make room, the state machines of
+	// the evicted requests get Timeout
+	OVERFLOW_DROP_OLDEST
+)
+
+// BoundedQueue limits the queued payloads by bytes (and optionally by
+// count), and gives callers a backpressure signal according to the
+// OverflowPolicy instead of piling up goroutines behind a full channel.
+type BoundedQueue struct {
+	mtx      sync.Mutex
+	items    [][]byte
+	bytes    int
+	maxBytes int
+	maxItems int // <= 0 means unlimited
+	policy   OverflowPolicy
+	closed   bool
+	// closed and renewed to wake up the waiters
+	notEmpty chan struct{}
+	notFull  chan struct{}
+	dropped  uint64
+}
+
+func NewBoundedQueue(maxBytes, maxItems int, policy OverflowPolicy) *BoundedQueue {
+	if maxBytes <= 0 {
+		maxBytes = DEFAULT_QUEUE_MAX_BYTES
+	}
+
+	return &BoundedQueue{
+		items:    make([][]byte, 0, DEFAULT_QUEUE_CAP),
+		maxBytes: maxBytes,
+		maxItems: maxItems,
+		policy:   policy,
+		notEmpty: make(chan struct{}),
+		notFull:  make(chan struct{}),
+	}
+}
+
+// an oversize payload is still accepted by an empty queue, otherwise it never could be sent
+func (q *BoundedQueue) fits(size int) bool {
+	if len(q.items) == 0 {
+		return true
+	}
+
+	if q.maxItems > 0 && len(q.items) >= q.maxItems {
+		return false
+	}
+	return q.bytes+size <= q.maxBytes
+}
+
+// call with lock held
+func (q *BoundedQueue) push(payload []byte) {
+	q.items = append(q.items, payload)
+	q.bytes += len(payload)
+	close(q.notEmpty)
+	q.notEmpty = make(chan struct{})
+}
+
+// call with lock held
+func (q *BoundedQueue) pop() []byte {
+	payload := q.items[0]
+	q.items[0] = nil // help gc
+	q.items = q.items[1:]
+	q.bytes -= len(payload)
+	if !q.closed {
+		close(q.notFull)
+		q.notFull = make(chan struct{})
+	}
+	return payload
+}
+
+// call with lock held, return false if the payload can't be queued without waiting
+func (q *BoundedQueue) tryPush(payload []byte) (bool, error) {
+	if q.closed {
+		return false, ErrQueueClosed
+	}
+
+	if q.fits(len(payload)) {
+		q.push(payload)
+		return true, nil
+	}
+
+	switch q.policy {
+	case OVERFLOW_REJECT:
+		return false, ErrQueueFull
+	case OVERFLOW_DROP_OLDEST:
+		for !q.fits(len(payload)) {
+			q.pop()
+			atomic.AddUint64(&q.dropped, 1)
+		}
+		q.push(payload)
+		return true, nil
+	}
+	return false, nil
+}
+
+func (q *BoundedQueue) Push(payload []byte) {
+	// rejected payload is counted as dropped
+	if q.PushContext(context.Background(), payload) != nil {
+		atomic.AddUint64(&q.dropped, 1)
+	}
+}
+
+func (q *BoundedQueue) TryPush(payload []byte) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	ok, err := q.tryPush(payload)
+	if !ok && err == nil {
+		err = ErrQueueFull
+	}
+	return err
+}
+
+func (q *BoundedQueue) PushContext(ctx context.Context, payload []byte) error {
+	for {
+		q.mtx.Lock()
+		ok, err := q.tryPush(payload)
+		notFull := q.notFull
+		q.mtx.Unlock()
+		if ok || err != nil {
+			return err
+		}
+
+		select {
+		case <-notFull:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// return nil after Drop
+func (q *BoundedQueue) Pop() (payload []byte) {
+	for {
+		q.mtx.Lock()
+		if len(q.items) > 0 {
+			payload = q.pop()
+			q.mtx.Unlock()
+			return payload
+		}
+
+		if q.closed {
+			q.mtx.Unlock()
+			return nil
+		}
+		notEmpty := q.notEmpty
+		q.mtx.Unlock()
+		<-notEmpty
+	}
+}
+
+func (q *BoundedQueue) PopBatch(buf [][]byte, latency time.Duration) int {
+	var (
+		n        int
+		deadline <-chan time.Time
+	)
+	for {
+		q.mtx.Lock()
+		for n < len(buf) && len(q.items) > 0 {
+			buf[n] = q.pop()
+			n++
+		}
+
+		if n == len(buf) || (n > 0 && latency <= 0) || q.closed {
+			q.mtx.Unlock()
+			return n
+		}
+		notEmpty := q.notEmpty
+		q.mtx.Unlock()
+
+		if n == 0 {
+			<-notEmpty
+			continue
+		}
+
+		if deadline == nil {
+			t := time.NewTimer(latency)
+			defer t.Stop()
+			deadline = t.C
+		}
+
+		select {
+		case <-notEmpty:
+		case <-deadline:
+			return n
+		}
+	}
+}
+
+func (q *BoundedQueue) PopNoBlocking() (payload []byte) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if len(q.items) == 0 {
+		return nil
+	}
+	return q.pop()
+}
+
+func (q *BoundedQueue) Drop() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	close(q.notEmpty)
+	close(q.notFull)
+}
+
+// queued bytes
+func (q *BoundedQueue) Bytes() int {
+	q.mtx.Lock()
+	n := q.bytes
+	q.mtx.Unlock()
+	return n
+}
+
+func (q *BoundedQueue) Len() int {
+	q.mtx.Lock()
+	n := len(q.items)
+	q.mtx.Unlock()
+	return n
+}
+
+// number of payloads dropped by the overflow policy
+func (q *BoundedQueue) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+func NewBoundedQueueGenerator(maxBytes, maxItems int, policy OverflowPolicy) func(TransportKey) (Queue, error) {
+	return func(key TransportKey) (Queue, error) {
+		return NewBoundedQueue(maxBytes, maxItems, policy), nil
+	}
+}
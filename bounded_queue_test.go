@@ -0,0 +1,137 @@
+package listenrain
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDefaultQueueCap(t *testing.T) {
+	cases := []struct {
+		cap, expect int
+	}{
+		{0, DEFAULT_QUEUE_CAP},
+		{-1, DEFAULT_QUEUE_CAP},
+		{16, 16},
+		{MAX_QUEUE_CAP + 1, MAX_QUEUE_CAP},
+	}
+	for _, c := range cases {
+		if n := cap(NewDefaultQueue(c.cap).q); n != c.expect {
+			t.Errorf("cap:%d, expect %d, got %d", c.cap, c.expect, n)
+		}
+	}
+}
+
+func TestDefaultQueueTryPush(t *testing.T) {
+	q := NewDefaultQueue(1)
+	if err := q.TryPush([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.TryPush([]byte("b")); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expect ErrQueueFull, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.PushContext(ctx, []byte("b")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestBoundedQueueReject(t *testing.T) {
+	q := NewBoundedQueue(8, 0, OVERFLOW_REJECT)
+	if err := q.TryPush(make([]byte, 6)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.PushContext(context.Background(), make([]byte, 3)); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expect ErrQueueFull for the bytes limit, got %v", err)
+	}
+
+	if err := q.TryPush(make([]byte, 2)); err != nil {
+		t.Fatalf("the payload fits, %v", err)
+	}
+
+	if q.Bytes() != 8 || q.Len() != 2 {
+		t.Fatalf("unexpected bytes:%d, len:%d", q.Bytes(), q.Len())
+	}
+}
+
+func TestBoundedQueueOversizePayload(t *testing.T) {
+	q := NewBoundedQueue(8, 0, OVERFLOW_REJECT)
+	// an empty queue takes any payload, otherwise it never could be sent
+	if err := q.TryPush(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoundedQueueDropOldest(t *testing.T) {
+	q := NewBoundedQueue(0, 2, OVERFLOW_DROP_OLDEST)
+	for _, p := range []string{"a", "b", "c"} {
+		if err := q.TryPush([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if q.Dropped() != 1 {
+		t.Fatalf("expect 1 dropped, got %d", q.Dropped())
+	}
+
+	if p := q.Pop(); string(p) != "b" {
+		t.Fatalf("expect the oldest dropped, got %s", p)
+	}
+}
+
+func TestBoundedQueueBlock(t *testing.T) {
+	q := NewBoundedQueue(0, 1, OVERFLOW_BLOCK)
+	q.Push([]byte("a"))
+
+	done := make(chan error)
+	go func() {
+		done <- q.PushContext(context.Background(), []byte("b"))
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("push doesn't wait for room, %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	q.Pop()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoundedQueueDrop(t *testing.T) {
+	q := NewBoundedQueue(0, 0, OVERFLOW_BLOCK)
+	done := make(chan []byte)
+	go func() {
+		done <- q.Pop()
+	}()
+	q.Drop()
+
+	if p := <-done; p != nil {
+		t.Fatalf("expect nil after Drop, got %s", p)
+	}
+
+	if err := q.TryPush([]byte("a")); !errors.Is(err, ErrQueueClosed) {
+		t.Fatalf("expect ErrQueueClosed, got %v", err)
+	}
+}
+
+func TestTransportPushNoWait(t *testing.T) {
+	for _, q := range []Queue{NewDefaultQueue(1), NewPriorityQueue(nil, 1)} {
+		tr := &Transport{q: q}
+		so := newSendOptions([]SendOption{WithNoWait()})
+		if err := tr.push(&so, []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := tr.push(&so, []byte("b")); !errors.Is(err, ErrQueueFull) {
+			t.Fatalf("%T, expect ErrQueueFull, got %v", q, err)
+		}
+	}
+}
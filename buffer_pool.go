@@ -0,0 +1,115 @@
+package listenrain
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+const (
+	DEFAULT_READ_BUFFER_SIZE     = 1 << 14 // 16KiB
+	DEFAULT_BUFFER_POOL_MIN_SIZE = 1 << 9  // 512B
+	DEFAULT_BUFFER_POOL_MAX_SIZE = 1 << 22 // 4MiB
+)
+
+// BufferPool is a size-classed pool of packet buffers, the classes are
+// the powers of 2 between minSize and maxSize, the buffer larger than
+// maxSize is allocated directly and left to gc.
+//
+//	pool := NewBufferPool(DEFAULT_BUFFER_POOL_MIN_SIZE, DEFAULT_BUFFER_POOL_MAX_SIZE)
+//	edp := &DefaultEnDecPacket{
+//		AllocatePacketBuffer: pool.Allocate,
+//		ReleasePacketBuffer:  pool.Put,
+//	}
+type BufferPool struct {
+	minShift uint
+	classes  []sync.Pool
+}
+
+func NewBufferPool(minSize, maxSize int) *BufferPool {
+	if minSize <= 0 {
+		minSize = DEFAULT_BUFFER_POOL_MIN_SIZE
+	}
+
+	if maxSize < minSize {
+		maxSize = minSize
+	}
+
+	var minShift uint
+	for 1<<minShift < minSize {
+		minShift++
+	}
+
+	maxShift := minShift
+	for 1<<maxShift < maxSize {
+		maxShift++
+	}
+
+	p := &BufferPool{
+		minShift: minShift,
+		classes:  make([]sync.Pool, maxShift-minShift+1),
+	}
+
+	for i := range p.classes {
+		size := 1 << (minShift + uint(i))
+		p.classes[i].New = func() interface{} {
+			return make([]byte, size)
+		}
+	}
+	return p
+}
+
+// return the index of the smallest class holding size, -1 if it is too large
+func (p *BufferPool) class(size int) int {
+	shift := p.minShift
+	for 1<<shift < size {
+		shift++
+	}
+
+	idx := int(shift - p.minShift)
+	if idx >= len(p.classes) {
+		return -1
+	}
+	return idx
+}
+
+// The length of the buffer is size, the capacity is the size of its class
+func (p *BufferPool) Get(size int) []byte {
+	idx := p.class(size)
+	if idx < 0 {
+		return make([]byte, size)
+	}
+	return p.classes[idx].Get().([]byte)[:size]
+}
+
+// Only the buffer from Get is put back, others are left to gc
+func (p *BufferPool) Put(buf []byte) {
+	c := cap(buf)
+	if c == 0 || c&(c-1) != 0 {
+		return
+	}
+
+	idx := p.class(c)
+	if idx < 0 || 1<<(p.minShift+uint(idx)) != c {
+		return
+	}
+	p.classes[idx].Put(buf[:c])
+}
+
+// Same as Get, fits AllocatePacketBuffer of DefaultEnDecPacket
+func (p *BufferPool) Allocate(size uint32) ([]byte, error) {
+	return p.Get(int(size)), nil
+}
+
+// DecodePacket reads from the buffered reader, so the small frames don't cost
+// syscalls each, and a large body is read into the packet buffer directly
+func newPacketReader(ch Channel, size int) io.Reader {
+	if size < 0 {
+		return ch
+	}
+
+	if size == 0 {
+		size = DEFAULT_READ_BUFFER_SIZE
+	}
+	return bufio.NewReaderSize(ch, size)
+}
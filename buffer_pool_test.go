@@ -0,0 +1,111 @@
+package listenrain
+
+import (
+	"bufio"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBufferPoolClasses(t *testing.T) {
+	p := NewBufferPool(512, 4096)
+	cases := []struct {
+		size, cap int
+	}{
+		{1, 512},
+		{512, 512},
+		{513, 1024},
+		{4096, 4096},
+		// larger than the max class, allocated directly
+		{5000, 5000},
+	}
+	for _, c := range cases {
+		buf := p.Get(c.size)
+		if len(buf) != c.size || cap(buf) != c.cap {
+			t.Errorf("size:%d, expect len:%d cap:%d, got len:%d cap:%d", c.size, c.size, c.cap, len(buf), cap(buf))
+		}
+		p.Put(buf)
+	}
+}
+
+func TestBufferPoolPutForeignBuffer(t *testing.T) {
+	p := NewBufferPool(512, 4096)
+	// neither a class size nor a power of 2, left to gc
+	p.Put(make([]byte, 700))
+	p.Put(make([]byte, 8192))
+	if buf := p.Get(600); cap(buf) != 1024 {
+		t.Fatalf("expect the class of 1024, got cap:%d", cap(buf))
+	}
+}
+
+func TestNewPacketReader(t *testing.T) {
+	client, server := testTcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	ch := &TcpChannel{server}
+	if rd, ok := newPacketReader(ch, 0).(*bufio.Reader); !ok || rd.Size() != DEFAULT_READ_BUFFER_SIZE {
+		t.Fatal("expect the default buffered reader")
+	}
+
+	if rd, ok := newPacketReader(ch, 100).(*bufio.Reader); !ok || rd.Size() != 100 {
+		t.Fatal("expect the buffered reader of 100 bytes")
+	}
+
+	if rd := newPacketReader(ch, -1); rd != Channel(ch) {
+		t.Fatal("expect the channel itself")
+	}
+}
+
+// the buffers of the packets are released after the router and the state machine return
+func TestPacketBufferReleased(t *testing.T) {
+	var serverReleased, clientReleased int32
+	pool := NewBufferPool(0, 0)
+	lr := NewListenRain(NewDefaultTransportPool())
+	key := testServer(t, testEchoRouter, func(pt *protocolType) {
+		pt.EdP = &DefaultEnDecPacket{
+			AllocatePacketBuffer: pool.Allocate,
+			ReleasePacketBuffer: func(buf []byte) {
+				atomic.AddInt32(&serverReleased, 1)
+				pool.Put(buf)
+			},
+		}
+	})
+	ptyp := testClient(lr, func(pt *protocolType) {
+		pt.EdP = &DefaultEnDecPacket{
+			ReleasePacketBuffer: func(buf []byte) {
+				atomic.AddInt32(&clientReleased, 1)
+			},
+		}
+	})
+
+	sm := newTestStatMachine()
+	for _, msg := range []string{"a:1", "b:2", "c:3"} {
+		if err := lr.Send(ptyp, sm, key, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-sm.results:
+		case <-time.After(testTimeout()):
+			t.Fatal("response timeout")
+		}
+	}
+
+	// the buffer of SyncSend is handed over to the caller, never released
+	if _, err := lr.SyncSend(ptyp, key, "d:4"); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if atomic.LoadInt32(&serverReleased) == 4 && atomic.LoadInt32(&clientReleased) == 3 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expect 4 server and 3 client releases, got %d and %d",
+		atomic.LoadInt32(&serverReleased), atomic.LoadInt32(&clientReleased))
+}
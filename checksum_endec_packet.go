@@ -0,0 +1,107 @@
+// The EnDecPacket wrapper protecting each frame with a CRC32C trailer,
+// a corrupted frame or a framing desync surfaces as ErrPacketCorrupted,
+// the client transport reconnects, the server closes the connection.
+//
+// format:
+//
+//	+--------------------------------+----------------------------+
+//	|            payload             |  crc32c of payload         |
+//	+--------------------------------+----------------------------+
+//	|           left bytes           |   4 byte (big endian)      |
+//	+--------------------------------+----------------------------+
+package listenrain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+)
+
+const (
+	CHECKSUM_BYTE_SIZE = 4
+)
+
+var (
+	ErrPacketCorrupted = errors.New("packet corrupted")
+
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type ChecksumError struct {
+	Expect uint32
+	Actual uint32
+	Size   int
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("packet checksum mismatch, expect:%08x, actual:%08x, size:%d", e.Expect, e.Actual, e.Size)
+}
+
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrPacketCorrupted || target == ErrProtocolViolation
+}
+
+type ChecksumEnDecPacket struct {
+	// the framing wrapped, such as DefaultEnDecPacket
+	EdP EnDecPacket
+	// nil means CRC32C (Castagnoli)
+	Table *crc32.Table
+}
+
+func NewChecksumEnDecPacket(edp EnDecPacket) *ChecksumEnDecPacket {
+	return &ChecksumEnDecPacket{
+		EdP: edp,
+	}
+}
+
+func (ed *ChecksumEnDecPacket) table() *crc32.Table {
+	if ed.Table == nil {
+		return castagnoliTable
+	}
+	return ed.Table
+}
+
+func (ed *ChecksumEnDecPacket) seal(payload []byte) []byte {
+	frame := make([]byte, len(payload)+CHECKSUM_BYTE_SIZE)
+	copy(frame, payload)
+	binary.BigEndian.PutUint32(frame[len(payload):], crc32.Checksum(payload, ed.table()))
+	return frame
+}
+
+func (ed *ChecksumEnDecPacket) EncodePacket(w io.Writer, payload []byte) error {
+	return ed.EdP.EncodePacket(w, ed.seal(payload))
+}
+
+func (ed *ChecksumEnDecPacket) AppendPacket(bufs net.Buffers, payload []byte) (net.Buffers, error) {
+	return appendPacket(ed.EdP, bufs, ed.seal(payload))
+}
+
+func (ed *ChecksumEnDecPacket) DecodePacket(r io.Reader) ([]byte, error) {
+	buf, err := ed.EdP.DecodePacket(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) < CHECKSUM_BYTE_SIZE {
+		ed.ReleasePacket(buf)
+		return nil, fmt.Errorf("%w, size:%d is less than the checksum", ErrPacketCorrupted, len(buf))
+	}
+
+	size := len(buf) - CHECKSUM_BYTE_SIZE
+	expect := binary.BigEndian.Uint32(buf[size:])
+	actual := crc32.Checksum(buf[:size], ed.table())
+	if expect != actual {
+		ed.ReleasePacket(buf)
+		return nil, &ChecksumError{Expect: expect, Actual: actual, Size: size}
+	}
+	return buf[:size], nil
+}
+
+func (ed *ChecksumEnDecPacket) ReleasePacket(buf []byte) {
+	if releaser, ok := ed.EdP.(PacketBufferReleaser); ok && buf != nil {
+		releaser.ReleasePacket(buf)
+	}
+}
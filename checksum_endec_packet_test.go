@@ -0,0 +1,124 @@
+package listenrain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChecksumEnDecPacketRoundTrip(t *testing.T) {
+	edp := NewChecksumEnDecPacket(&DefaultEnDecPacket{})
+	var buf bytes.Buffer
+	if err := edp.EncodePacket(&buf, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.Len() != DEFAULT_PACKET_HEAD_BYTE_SIZE+5+CHECKSUM_BYTE_SIZE {
+		t.Fatalf("unexpected frame size %d", buf.Len())
+	}
+
+	p, err := edp.DecodePacket(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(p) != "hello" {
+		t.Fatalf("unexpected payload %q", p)
+	}
+}
+
+func TestChecksumEnDecPacketCorrupted(t *testing.T) {
+	edp := NewChecksumEnDecPacket(&DefaultEnDecPacket{})
+	var buf bytes.Buffer
+	if err := edp.EncodePacket(&buf, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := buf.Bytes()
+	frame[DEFAULT_PACKET_HEAD_BYTE_SIZE] ^= 0xff
+	_, err := edp.DecodePacket(bytes.NewReader(frame))
+	var csErr *ChecksumError
+	if !errors.As(err, &csErr) || csErr.Size != 5 {
+		t.Fatalf("expect *ChecksumError, got %v", err)
+	}
+
+	if !errors.Is(err, ErrPacketCorrupted) || !errors.Is(err, ErrProtocolViolation) {
+		t.Fatalf("expect ErrPacketCorrupted and ErrProtocolViolation, got %v", err)
+	}
+
+	// shorter than the checksum
+	buf.Reset()
+	if err := (&DefaultEnDecPacket{}).EncodePacket(&buf, []byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := edp.DecodePacket(&buf); !errors.Is(err, ErrPacketCorrupted) {
+		t.Fatalf("expect ErrPacketCorrupted, got %v", err)
+	}
+}
+
+// the framing without AppendPacket is encoded into one buffer
+type encodeOnlyEnDecPacket struct {
+	EnDecPacket
+}
+
+func TestChecksumEnDecPacketAppend(t *testing.T) {
+	for _, inner := range []EnDecPacket{&DefaultEnDecPacket{}, encodeOnlyEnDecPacket{&DefaultEnDecPacket{}}} {
+		edp := NewChecksumEnDecPacket(inner)
+		bufs, err := edp.AppendPacket(nil, []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if _, err := bufs.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := edp.DecodePacket(&buf)
+		if err != nil {
+			t.Fatalf("%T, %v", inner, err)
+		}
+
+		if string(p) != "hello" {
+			t.Fatalf("%T, unexpected payload %q", inner, p)
+		}
+	}
+}
+
+// the server closes the connection sending a corrupted frame
+func TestServerClosesCorruptedConnection(t *testing.T) {
+	var pt *protocolType
+	key := testServer(t, testEchoRouter, func(p *protocolType) {
+		p.EdP = NewChecksumEnDecPacket(&DefaultEnDecPacket{})
+		pt = p
+	})
+
+	conn, err := net.Dial("tcp", key.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// "a:1" with a wrong checksum
+	frame := make([]byte, DEFAULT_PACKET_HEAD_BYTE_SIZE+3+CHECKSUM_BYTE_SIZE)
+	binary.BigEndian.PutUint32(frame, 3+CHECKSUM_BYTE_SIZE)
+	copy(frame[DEFAULT_PACKET_HEAD_BYTE_SIZE:], "a:1")
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(testTimeout()))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expect the connection closed, got %v", err)
+	}
+
+	if n := atomic.LoadUint64(&pt.violations); n != 1 {
+		t.Fatalf("expect 1 protocol violation, got %d", n)
+	}
+}
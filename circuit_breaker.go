@@ -0,0 +1,310 @@
+package listenrain
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_CIRCUIT_WINDOW       = 10 * time.Second
+	DEFAULT_CIRCUIT_MIN_REQUESTS = 20
+	DEFAULT_CIRCUIT_FAILURE_RATE = 0.5
+	DEFAULT_CIRCUIT_OPEN_TIMEOUT = 5 * time.Second
+)
+
+type CircuitState uint8
+
+const (
+	// the requests go through, the failures are counted
+	CIRCUIT_CLOSED CircuitState = iota
+	// the requests fail fast with *CircuitOpenError
+	CIRCUIT_OPEN
+	// a few probes go through, they close the circuit if all succeed
+	CIRCUIT_HALF_OPEN
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CIRCUIT_CLOSED:
+		return "closed"
+	case CIRCUIT_OPEN:
+		return "open"
+	case CIRCUIT_HALF_OPEN:
+		return "half-open"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(s))
+}
+
+var (
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+)
+
+type CircuitOpenError struct {
+	Key string
+	// until the circuit becomes half-open, 0 when it is half-open without free probes
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker of %s is open, retry after %s", e.Key, e.RetryAfter)
+}
+
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// The settings of the circuit breakers of a client protocol type, one
+// breaker per TransportKey. The timeouts, transport errors and the
+// ERROR_CODE_INTERNAL/ERROR_CODE_OVERLOAD responses are the failures.
+type CircuitBreakerConfig struct {
+	// the tumbling window the failure rate is computed over, 0 means DEFAULT_CIRCUIT_WINDOW
+	Window time.Duration
+	// requests of the window before the circuit may open, 0 means DEFAULT_CIRCUIT_MIN_REQUESTS
+	MinRequests int
+	// in (0, 1], 0 means DEFAULT_CIRCUIT_FAILURE_RATE
+	FailureRate float64
+	// how long the circuit stays open, 0 means DEFAULT_CIRCUIT_OPEN_TIMEOUT
+	OpenTimeout time.Duration
+	// the probes of the half-open circuit, 0 means 1
+	HalfOpenProbes int
+	// called on the state changes for monitoring, without the lock of the breaker
+	OnStateChange func(key string, from, to CircuitState)
+}
+
+type CircuitBreaker struct {
+	mtx         sync.Mutex
+	key         string
+	window      time.Duration
+	minRequests int
+	failureRate float64
+	openTimeout time.Duration
+	probes      int
+	onChange    func(key string, from, to CircuitState)
+
+	state CircuitState
+	// bumped on every state change, the outcome of a request admitted
+	// in an earlier generation is ignored
+	generation  uint64
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	// half-open probes admitted and succeeded
+	admitted  int
+	succeeded int
+}
+
+func NewCircuitBreaker(key string, cfg *CircuitBreakerConfig) *CircuitBreaker {
+	cb := &CircuitBreaker{
+		key:         key,
+		window:      cfg.Window,
+		minRequests: cfg.MinRequests,
+		failureRate: cfg.FailureRate,
+		openTimeout: cfg.OpenTimeout,
+		probes:      cfg.HalfOpenProbes,
+		onChange:    cfg.OnStateChange,
+		generation:  1,
+		windowStart: time.Now(),
+	}
+
+	if cb.window <= 0 {
+		cb.window = DEFAULT_CIRCUIT_WINDOW
+	}
+
+	if cb.minRequests <= 0 {
+		cb.minRequests = DEFAULT_CIRCUIT_MIN_REQUESTS
+	}
+
+	if cb.failureRate <= 0 {
+		cb.failureRate = DEFAULT_CIRCUIT_FAILURE_RATE
+	}
+
+	if cb.openTimeout <= 0 {
+		cb.openTimeout = DEFAULT_CIRCUIT_OPEN_TIMEOUT
+	}
+
+	if cb.probes <= 0 {
+		cb.probes = 1
+	}
+	return cb
+}
+
+// return *CircuitOpenError if the request must fail fast, otherwise
+// the outcome of the request must be reported by Done with the
+// generation returned
+func (cb *CircuitBreaker) Allow() (uint64, error) {
+	cb.mtx.Lock()
+	from := cb.state
+	now := time.Now()
+	if cb.state == CIRCUIT_OPEN {
+		if wait := cb.openedAt.Add(cb.openTimeout).Sub(now); wait > 0 {
+			cb.mtx.Unlock()
+			return 0, &CircuitOpenError{Key: cb.key, RetryAfter: wait}
+		}
+		cb.state = CIRCUIT_HALF_OPEN
+		cb.generation++
+		cb.admitted, cb.succeeded = 0, 0
+	}
+
+	var err error
+	if cb.state == CIRCUIT_HALF_OPEN {
+		if cb.admitted < cb.probes {
+			cb.admitted++
+		} else {
+			err = &CircuitOpenError{Key: cb.key}
+		}
+	}
+	gen := cb.generation
+	to := cb.state
+	cb.mtx.Unlock()
+
+	cb.changed(from, to)
+	return gen, err
+}
+
+// the outcome of the request admitted in the generation gen, e.g. the late
+// response of a request sent before the circuit opened is not a probe
+func (cb *CircuitBreaker) Done(gen uint64, success bool) {
+	cb.mtx.Lock()
+	if gen != cb.generation {
+		cb.mtx.Unlock()
+		return
+	}
+
+	from := cb.state
+	now := time.Now()
+	switch cb.state {
+	case CIRCUIT_CLOSED:
+		if now.Sub(cb.windowStart) >= cb.window {
+			cb.windowStart = now
+			cb.requests, cb.failures = 0, 0
+		}
+
+		cb.requests++
+		if !success {
+			cb.failures++
+		}
+
+		if cb.requests >= cb.minRequests && float64(cb.failures) >= cb.failureRate*float64(cb.requests) {
+			cb.open(now)
+		}
+	case CIRCUIT_HALF_OPEN:
+		if !success {
+			cb.open(now)
+			break
+		}
+
+		cb.succeeded++
+		if cb.succeeded >= cb.probes {
+			cb.state = CIRCUIT_CLOSED
+			cb.generation++
+			cb.windowStart = now
+			cb.requests, cb.failures = 0, 0
+		}
+	}
+	to := cb.state
+	cb.mtx.Unlock()
+
+	cb.changed(from, to)
+}
+
+// the request admitted by Allow in the generation gen is not sent, its
+// outcome is not counted
+func (cb *CircuitBreaker) Cancel(gen uint64) {
+	cb.mtx.Lock()
+	if gen == cb.generation && cb.state == CIRCUIT_HALF_OPEN && cb.admitted > 0 {
+		cb.admitted--
+	}
+	cb.mtx.Unlock()
+}
+
+// must be called with mtx held
+func (cb *CircuitBreaker) open(now time.Time) {
+	cb.state = CIRCUIT_OPEN
+	cb.generation++
+	cb.openedAt = now
+}
+
+func (cb *CircuitBreaker) changed(from, to CircuitState) {
+	if from != to && cb.onChange != nil {
+		cb.onChange(cb.key, from, to)
+	}
+}
+
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mtx.Lock()
+	s := cb.state
+	cb.mtx.Unlock()
+	return s
+}
+
+// the outcome of the response v
+func responseSucceeded(v interface{}) bool {
+	if rerr, ok := v.(*RemoteError); ok {
+		return rerr.Code != ERROR_CODE_INTERNAL && rerr.Code != ERROR_CODE_OVERLOAD
+	}
+	return true
+}
+
+// the breaker of the endpoint shared by the transports of the protocol type,
+// nil if the protocol type has no CircuitBreaker
+func (pt *protocolType) circuitBreaker(endpoint string) *CircuitBreaker {
+	if pt.CircuitBreaker == nil {
+		return nil
+	}
+
+	if v, ok := pt.breakers.Load(endpoint); ok {
+		return v.(*CircuitBreaker)
+	}
+	v, _ := pt.breakers.LoadOrStore(endpoint, NewCircuitBreaker(endpoint, pt.CircuitBreaker))
+	return v.(*CircuitBreaker)
+}
+
+func (pt *protocolType) admit(endpoint string) (admission, error) {
+	return pt.circuitBreaker(endpoint).admit()
+}
+
+// Key of the endpoint ch is connected to, key.Key() unless ch is
+// connected to a standby endpoint of HATCPTransportKey
+func endpointKey(key TransportKey, ch Channel) string {
+	if ha, ok := key.(*HATCPTransportKey); ok {
+		if i := ha.connectedEndpoint(ch); i >= 0 {
+			return (&ha.endpoints[i]).Key()
+		}
+	}
+	return key.Key()
+}
+
+// The request admitted by the circuit breaker, the zero one was not
+// admitted by any
+type admission struct {
+	cb  *CircuitBreaker
+	gen uint64
+}
+
+// nil breaker admits the request without admission
+func (cb *CircuitBreaker) admit() (admission, error) {
+	if cb == nil {
+		return admission{}, nil
+	}
+
+	gen, err := cb.Allow()
+	if err != nil {
+		return admission{}, err
+	}
+	return admission{cb: cb, gen: gen}, nil
+}
+
+func (a admission) done(success bool) {
+	if a.cb != nil {
+		a.cb.Done(a.gen, success)
+	}
+}
+
+func (a admission) cancel() {
+	if a.cb != nil {
+		a.cb.Cancel(a.gen)
+	}
+}
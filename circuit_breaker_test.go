@@ -0,0 +1,296 @@
+package listenrain
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func testBreaker(changes *[]CircuitState) *CircuitBreaker {
+	return NewCircuitBreaker("test", &CircuitBreakerConfig{
+		MinRequests: 2,
+		FailureRate: 0.6,
+		OpenTimeout: 20 * time.Millisecond,
+		OnStateChange: func(key string, from, to CircuitState) {
+			if changes != nil {
+				*changes = append(*changes, to)
+			}
+		},
+	})
+}
+
+// fail the requests of the closed circuit until it opens
+func testOpenBreaker(t *testing.T, cb *CircuitBreaker) {
+	t.Helper()
+	for i := 0; i < 2; i++ {
+		gen, err := cb.Allow()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cb.Done(gen, false)
+	}
+
+	if cb.State() != CIRCUIT_OPEN {
+		t.Fatalf("expect open, got %s", cb.State())
+	}
+}
+
+func TestCircuitBreakerStates(t *testing.T) {
+	var changes []CircuitState
+	cb := testBreaker(&changes)
+
+	gen, _ := cb.Allow()
+	cb.Done(gen, true)
+	gen, _ = cb.Allow()
+	cb.Done(gen, false)
+	if cb.State() != CIRCUIT_CLOSED {
+		t.Fatalf("1 failure of 2 requests is below the rate, got %s", cb.State())
+	}
+
+	gen, _ = cb.Allow()
+	cb.Done(gen, false)
+	if cb.State() != CIRCUIT_OPEN {
+		t.Fatalf("expect open, got %s", cb.State())
+	}
+
+	_, err := cb.Allow()
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) || openErr.RetryAfter <= 0 || !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expect *CircuitOpenError with RetryAfter, got %v", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	gen, err = cb.Allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cb.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expect one probe, got %v", err)
+	}
+
+	cb.Done(gen, true)
+	if cb.State() != CIRCUIT_CLOSED {
+		t.Fatalf("expect closed, got %s", cb.State())
+	}
+
+	expect := []CircuitState{CIRCUIT_OPEN, CIRCUIT_HALF_OPEN, CIRCUIT_CLOSED}
+	if len(changes) != len(expect) {
+		t.Fatalf("expect changes %v, got %v", expect, changes)
+	}
+	for i := range expect {
+		if changes[i] != expect[i] {
+			t.Fatalf("expect changes %v, got %v", expect, changes)
+		}
+	}
+}
+
+func TestCircuitBreakerFailedProbe(t *testing.T) {
+	cb := testBreaker(nil)
+	testOpenBreaker(t, cb)
+
+	time.Sleep(30 * time.Millisecond)
+	gen, err := cb.Allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cb.Done(gen, false)
+	if cb.State() != CIRCUIT_OPEN {
+		t.Fatalf("expect open again, got %s", cb.State())
+	}
+}
+
+// the late outcome of the request admitted before the circuit opened is not a probe
+func TestCircuitBreakerIgnoresStaleOutcome(t *testing.T) {
+	cb := testBreaker(nil)
+	stale, err := cb.Allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testOpenBreaker(t, cb)
+
+	time.Sleep(30 * time.Millisecond)
+	probe, err := cb.Allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cb.Done(stale, true)
+	if cb.State() != CIRCUIT_HALF_OPEN {
+		t.Fatalf("the stale success closed the circuit, got %s", cb.State())
+	}
+
+	cb.Cancel(stale)
+	if _, err := cb.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("the stale cancel freed the probe, got %v", err)
+	}
+
+	cb.Done(stale, false)
+	if cb.State() != CIRCUIT_HALF_OPEN {
+		t.Fatalf("the stale failure opened the circuit, got %s", cb.State())
+	}
+
+	cb.Done(probe, true)
+	if cb.State() != CIRCUIT_CLOSED {
+		t.Fatalf("expect closed, got %s", cb.State())
+	}
+}
+
+func TestCircuitBreakerCancelProbe(t *testing.T) {
+	cb := testBreaker(nil)
+	testOpenBreaker(t, cb)
+
+	time.Sleep(30 * time.Millisecond)
+	gen, err := cb.Allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cb.Cancel(gen)
+	if _, err := cb.Allow(); err != nil {
+		t.Fatalf("the cancelled probe is given back, got %v", err)
+	}
+}
+
+func TestResponseSucceeded(t *testing.T) {
+	cases := []struct {
+		v       interface{}
+		success bool
+	}{
+		{"a:1", true},
+		{&RemoteError{Code: ERROR_CODE_INTERNAL}, false},
+		{&RemoteError{Code: ERROR_CODE_OVERLOAD}, false},
+		{&RemoteError{Code: ERROR_CODE_BAD_REQUEST}, true},
+	}
+	for _, c := range cases {
+		if responseSucceeded(c.v) != c.success {
+			t.Fatalf("%v, expect success %v", c.v, c.success)
+		}
+	}
+}
+
+func TestCircuitBreakerOpensOnTimeouts(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	key := testServer(t, testSilentRouter, nil)
+	ptyp := testClient(lr, func(pt *protocolType) {
+		pt.CircuitBreaker = &CircuitBreakerConfig{MinRequests: 1, OpenTimeout: time.Hour}
+	})
+
+	if _, err := lr.SyncSend(ptyp, key, "a:1", WithTimeout(50*time.Millisecond)); err == nil {
+		t.Fatal("expect the timeout")
+	}
+
+	if s := lr.CircuitState(ptyp, key); s != CIRCUIT_OPEN {
+		t.Fatalf("expect open, got %s", s)
+	}
+
+	if err := lr.Send(ptyp, newTestStatMachine(), key, "b:1"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expect ErrCircuitOpen, got %v", err)
+	}
+}
+
+// the request rejected before it goes out is not a failure
+func TestCircuitBreakerIgnoresRejectedSend(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	key := testServer(t, testEchoRouter, nil)
+	ptyp := testClient(lr, func(pt *protocolType) {
+		pt.CircuitBreaker = &CircuitBreakerConfig{MinRequests: 1, OpenTimeout: time.Hour}
+	})
+
+	err := lr.Send(ptyp, newTestStatMachine(), key, "a:1", WithMetadata(Metadata{"k": "v"}))
+	if !errors.Is(err, ErrMultiplexRequired) {
+		t.Fatalf("expect ErrMultiplexRequired, got %v", err)
+	}
+
+	if s := lr.CircuitState(ptyp, key); s != CIRCUIT_CLOSED {
+		t.Fatalf("expect closed, got %s", s)
+	}
+
+	if _, err := lr.SyncSend(ptyp, key, "b:1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the local backpressure of the full queue is not the failure of the backend
+func TestCircuitBreakerIgnoresQueueFull(t *testing.T) {
+	q := NewBoundedQueue(0, 1, OVERFLOW_REJECT)
+	q.Push([]byte("pending"))
+	smp, _ := DefaultStatMachinePoolGenerator(nil)
+	tr := &Transport{
+		q:               q,
+		edP:             &DefaultEnDecPacket{},
+		edM:             testCodec{},
+		pt:              &protocolType{},
+		statmachinePool: smp,
+		t:               NewTimer(),
+		admissions:      make(map[timerKey]admission),
+	}
+
+	cb := NewCircuitBreaker("test", &CircuitBreakerConfig{MinRequests: 1, OpenTimeout: time.Hour})
+	adm, err := cb.admit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	so := newSendOptions([]SendOption{WithNoWait()})
+	if _, err := tr.send(newTestStatMachine(), testKey(t), "a:1", &so, adm); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expect ErrQueueFull, got %v", err)
+	}
+
+	if s := cb.State(); s != CIRCUIT_CLOSED {
+		t.Fatalf("expect closed, got %s", s)
+	}
+}
+
+// after the failover, the breaker of the standby endpoint admits the requests
+func TestCircuitBreakerPerEndpoint(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	mux := func(pt *protocolType) { pt.Multiplex = true }
+	standby := testServer(t, func(response ServerResponse, msgId string, cmd int, message interface{}) error {
+		if message == "f:1" {
+			return nil
+		}
+		return response.Response(message)
+	}, mux)
+	key := testFailedOverHAKey(t, standby)
+	ptyp := testClient(lr, func(pt *protocolType) {
+		pt.Multiplex = true
+		pt.CircuitBreaker = &CircuitBreakerConfig{MinRequests: 1, OpenTimeout: time.Hour}
+	})
+
+	// the request lost with the closed connection may open the breaker of the active endpoint
+	var err error
+	for i := 0; i < 10; i++ {
+		if _, err = lr.SyncSend(ptyp, key, "w:1", WithTimeout(200*time.Millisecond)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("the transport doesn't fail over, %v", err)
+	}
+
+	active := lr.protoTyps[ptyp].circuitBreaker(key.Key())
+	if gen, err := active.Allow(); err == nil {
+		active.Done(gen, false)
+	}
+	if s := lr.CircuitState(ptyp, key); s != CIRCUIT_OPEN {
+		t.Fatalf("expect the breaker of the active endpoint open, got %s", s)
+	}
+
+	if _, err := lr.SyncSend(ptyp, key, "a:1"); err != nil {
+		t.Fatalf("the open breaker of the active endpoint rejects the standby one, %v", err)
+	}
+
+	if _, err := lr.SyncSend(ptyp, key, "f:1", WithTimeout(50*time.Millisecond)); err == nil {
+		t.Fatal("expect the timeout")
+	}
+
+	if s := lr.CircuitState(ptyp, standby); s != CIRCUIT_OPEN {
+		t.Fatalf("expect the breaker of the standby endpoint open, got %s", s)
+	}
+
+	if _, err := lr.SyncSend(ptyp, key, "b:1"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expect ErrCircuitOpen, got %v", err)
+	}
+}
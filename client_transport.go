@@ -1,11 +1,12 @@
 package listenrain
 
 import (
-	"container/heap"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,24 +23,48 @@ const (
 )
 
 type Transport struct {
-	q               Queue
-	edP             EnDecPacket
-	edM             EnDecMessage
-	cg              ChannelGenerator
-	wg              sync.WaitGroup
-	close           bool
+	q     Queue
+	edP   EnDecPacket
+	edM   EnDecMessage
+	cg    ChannelGenerator
+	wg    sync.WaitGroup
+	close bool
+	// set by the sender and the receiver of the channel
+	emtx            sync.Mutex
 	err             error
 	ch              Channel
 	pt              *protocolType
 	executor        Executor
 	statmachinePool StatMachinePool
 	t               *timer
-	tq              chan string
 	timeout         time.Duration
 	state           TransportState
+	reqId           uint64
+	muxPool         *muxStatMachinePool
+	releaser        PacketBufferReleaser
+	// nil means unlimited
+	inflight    *inflightSemaphore
+	keyInflight *inflightSemaphore
+	// the TransportKey the transport is created for
+	key TransportKey
+	// the breaker of the endpoint connected, nil if the protocol type has
+	// no CircuitBreaker
+	gmtx    sync.Mutex
+	breaker *CircuitBreaker
+	// the in-flight requests admitted by the breakers
+	admissions map[timerKey]admission
+	// the StatMachinePool without TryPut takes the reused msgId in turn
+	pmtx sync.Mutex
+	// heartbeat intervals since the last packet received
+	missed int32
 }
 
 func NewTransport(transportKey TransportKey, pt *protocolType) (*Transport, error) {
+	err := pt.validate()
+	if err != nil {
+		return nil, err
+	}
+
 	q, err := pt.QueueGenerator(transportKey)
 	if err != nil {
 		return nil, err
@@ -60,10 +85,19 @@ func NewTransport(transportKey TransportKey, pt *protocolType) (*Transport, erro
 		return nil, err
 	}
 
+	// a new transport connects to the endpoint of transportKey.Key() first,
+	// the dial fails fast while its breaker is open
+	dial, err := pt.admit(transportKey.Key())
+	if err != nil {
+		return nil, err
+	}
+
 	ch, err := cg.Next()
 	if err != nil {
+		dial.done(false)
 		return nil, err
 	}
+	dial.cancel()
 
 	if !ch.IsActive() {
 		cg.GC(ch)
@@ -80,8 +114,29 @@ func NewTransport(transportKey TransportKey, pt *protocolType) (*Transport, erro
 		executor:        exe,
 		statmachinePool: smp,
 		t:               NewTimer(),
-		tq:              make(chan string, 128),
 		state:           TRANSPORT_WORKING,
+		key:             transportKey,
+	}
+
+	if pt.Multiplex {
+		transport.muxPool = newMuxStatMachinePool()
+	}
+
+	if releaser, ok := pt.EdP.(PacketBufferReleaser); ok {
+		transport.releaser = releaser
+	}
+
+	if pt.MaxInFlight > 0 {
+		transport.inflight = newInflightSemaphore(pt.MaxInFlight)
+	}
+
+	if pt.MaxInFlightPerKey > 0 {
+		transport.keyInflight = pt.keySemaphore(transportKey)
+	}
+
+	if pt.CircuitBreaker != nil {
+		transport.admissions = make(map[timerKey]admission)
+		transport.connected()
 	}
 
 	transport.init()
@@ -97,18 +152,41 @@ func (t *Transport) runLoop() {
 	var (
 		sndPayload []byte
 		closewg    = new(sync.WaitGroup)
+		bw         = newBatchWriter(t.pt, t.q)
 	)
+	if bw != nil && t.pt.Multiplex {
+		bw.prepare = t.stampDeadline
+	}
 	closewg.Add(1)
 	for {
+		// the heartbeats of the current channel
+		var stopHeartbeat chan struct{}
+		if t.pt.Multiplex && t.pt.HeartbeatInterval > 0 {
+			atomic.StoreInt32(&t.missed, 0)
+			stopHeartbeat = make(chan struct{})
+			go t.heartbeat(t.ch, stopHeartbeat)
+		}
+
 		t.wg.Add(2)
 		go func() {
 			for {
-				if sndPayload == nil {
-					sndPayload = t.q.Pop()
+				var err error
+				if bw != nil {
+					// the failed batch is kept and flushed again after recover
+					if bw.fill() > 0 {
+						err = bw.flush(t.ch)
+					}
+				} else {
+					if sndPayload == nil {
+						sndPayload = t.q.Pop()
+					}
+
+					if !t.pt.Multiplex || t.stampDeadline(sndPayload) {
+						err = dropUnencodable(t.edP.EncodePacket(t.ch, sndPayload))
+					}
 				}
-				err := t.edP.EncodePacket(t.ch, sndPayload)
 				if err != nil {
-					t.err = err
+					t.setErr(err)
 					// TODO
 					// callback app layer
 					break
@@ -116,7 +194,7 @@ func (t *Transport) runLoop() {
 					sndPayload = nil
 				}
 
-				if t.close || t.err != nil {
+				if t.close || t.Error() != nil {
 					break
 				}
 			}
@@ -136,19 +214,27 @@ func (t *Transport) runLoop() {
 		}()
 
 		go func() {
+			rd := newPacketReader(t.ch, t.pt.ReadBufferSize)
 			for {
-				rcvPayload, err := t.edP.DecodePacket(t.ch)
-				if t.close || t.err != nil {
+				rcvPayload, err := t.edP.DecodePacket(rd)
+				if t.close || t.Error() != nil {
 					break
 				}
 
 				if err != nil {
 					// TODO
 					log.Printf("client transport decode packet from %s failed, %s", t.ch.PeerInfo(), err)
-					t.err = err
+					if t.heartbeatTimeout() {
+						err = fmt.Errorf("%w, %s", ErrHeartbeatTimeout, err)
+					}
+					t.setErr(err)
+					// the stream can't be trusted anymore (e.g. ErrPacketCorrupted), the
+					// sender fails on the closed channel and keeps its payload for recover
+					t.ch.Close()
 					break
 				}
 
+				atomic.StoreInt32(&t.missed, 0)
 				t.executor.Process(t, rcvPayload)
 			}
 
@@ -157,7 +243,7 @@ func (t *Transport) runLoop() {
 				// just begin
 				time.Sleep(t.timeout / 2)
 				for {
-					rcvPayload, err := t.edP.DecodePacket(t.ch)
+					rcvPayload, err := t.edP.DecodePacket(rd)
 					if err != nil {
 						// callback app layer
 						log.Printf("client transport decode packet from %s failed, %s", t.ch.PeerInfo(), err)
@@ -175,6 +261,10 @@ func (t *Transport) runLoop() {
 		}()
 
 		t.wg.Wait()
+		if stopHeartbeat != nil {
+			close(stopHeartbeat)
+		}
+
 		if t.close {
 			break
 		}
@@ -193,7 +283,7 @@ func (t *Transport) runLoop() {
 			if exit {
 				// 主动退出
 				t.close = true
-				t.err = err
+				t.setErr(err)
 				t.cg.GC(ch)
 				t.cg.GC(t.ch)
 				t.ch = nil
@@ -201,9 +291,11 @@ func (t *Transport) runLoop() {
 			} else {
 				t.cg.GC(t.ch)
 				t.ch = ch
+				t.connected()
 			}
 
-			t.err = nil
+			t.setErr(nil)
+			t.state = TRANSPORT_WORKING
 			continue
 		}
 
@@ -220,129 +312,424 @@ func (t *Transport) Close() error {
 		t.cg.GC(t.ch)
 	}
 
-	return t.err
+	return t.Error()
 }
 
 func (t *Transport) Error() error {
+	t.emtx.Lock()
+	defer t.emtx.Unlock()
 	return t.err
 }
 
-func (t *Transport) Send(sm StatMachine, key TransportKey, msg interface{}) error {
+func (t *Transport) setErr(err error) {
+	t.emtx.Lock()
+	t.err = err
+	t.emtx.Unlock()
+}
+
+func (t *Transport) Send(sm StatMachine, key TransportKey, msg interface{}, opts ...SendOption) error {
+	so := newSendOptions(opts)
+	_, err := t.send(sm, key, msg, &so, admission{})
+	return err
+}
+
+// return the key of the request, for cancel, adm is the admission of the
+// request by the circuit breaker, the zero one if it was not admitted
+func (t *Transport) send(sm StatMachine, key TransportKey, msg interface{}, so *sendOptions, adm admission) (timerKey, error) {
+	tk, err := t.enqueue(sm, key, msg, so, adm)
+	if err != nil {
+		// the closed transport is the failure of the request, the one
+		// rejected before it could go out (e.g. the local backpressure
+		// of ErrQueueFull) is not counted
+		if t.close {
+			adm.done(false)
+		} else {
+			adm.cancel()
+		}
+	}
+	return tk, err
+}
+
+func (t *Transport) enqueue(sm StatMachine, key TransportKey, msg interface{}, so *sendOptions, adm admission) (timerKey, error) {
 	if t.close {
-		return fmt.Errorf("closed transport:%s", key.Key())
+		return timerKey{}, fmt.Errorf("closed transport:%s", key.Key())
 	}
 
+	timeout := so.timeoutOf(msg, t.pt)
+
 	payload, msgId, err := t.edM.EncodeMessage(msg)
 	if err != nil {
-		return err
+		return timerKey{}, err
 	}
 
-	t.statmachinePool.Put(msgId, sm)
-	t.q.Push(payload) // TODO how to deal with blocking?
-	t.tq <- msgId
-	return nil
-}
+	if so.md != nil && !t.pt.Multiplex {
+		// only the envelope of Multiplex carries the metadata
+		return timerKey{}, fmt.Errorf("metadata, %w", ErrMultiplexRequired)
+	}
 
-func (t *Transport) startTimer() {
-	tc := time.NewTicker(100 * time.Millisecond)
-	var (
-		index    int8 = -1
-		q        [TENT_QSIZE]*tentry
-		overflow bool = true
-		now      time.Time
-	)
+	_, unique := t.statmachinePool.(UniqueStatMachinePool)
+	if !unique && !t.pt.Multiplex {
+		// Put overwrites the request of the reused msgId, time it out with
+		// its slots before the new one waits for a slot
+		t.pmtx.Lock()
+		displaced := t.displace(msgId)
+		t.pmtx.Unlock()
+		t.timeoutDisplaced(displaced, msgId)
+	}
 
-	push := func(q []*tentry, index *int8, e *tentry) {
-		*index = *index + 1
-		q[*index] = e
+	// the slot is given back once the state machine is popped
+	err = t.acquire(so)
+	if err != nil {
+		return timerKey{}, err
 	}
 
-	fillq := func(timer time.Time) {
-		for {
-			v := t.t.Top()
-			if v == nil {
-				break
-			}
+	if t.pt.Multiplex {
+		reqId := atomic.AddUint64(&t.reqId, 1)
+		frame, err := encodeFrame(&frameHeader{kind: FRAME_REQUEST, reqId: reqId, timeout: timeout, md: so.md}, payload)
+		if err != nil {
+			t.release()
+			return timerKey{}, err
+		}
 
-			e := (v).(*tentry)
-			if e.timeout.Before(timer) {
-				heap.Pop(t.t)
-				push(q[:], &index, e)
-			} else {
-				break
+		t.track(timerKey{reqId: reqId}, adm)
+		t.muxPool.Put(reqId, sm, time.Now().Add(timeout))
+		t.t.Add(timerKey{reqId: reqId}, timeout)
+		err = t.push(so, frame)
+		if err != nil {
+			t.t.Cancel(timerKey{reqId: reqId})
+			if t.muxPool.Pop(reqId) != nil {
+				t.release()
+				t.admitted(timerKey{reqId: reqId})
 			}
+			return timerKey{}, err
+		}
+		return timerKey{reqId: reqId}, nil
+	}
 
-			if index+1 >= TENT_QSIZE {
-				overflow = true
-				break
-			}
+	if unique {
+		err = t.statmachinePool.(UniqueStatMachinePool).TryPut(msgId, sm)
+		if err != nil {
+			t.release()
+			return timerKey{}, fmt.Errorf("msgId:%s, %w", msgId, err)
 		}
+		// register before push, so that the response always finds the entry to cancel
+		t.track(timerKey{msgId: msgId}, adm)
+		t.t.Add(timerKey{msgId: msgId}, timeout)
+	} else {
+		// the request which took the msgId while this one waited for a
+		// slot is displaced as well, nothing comes in between
+		t.pmtx.Lock()
+		displaced := t.displace(msgId)
+		t.statmachinePool.Put(msgId, sm)
+		t.track(timerKey{msgId: msgId}, adm)
+		t.t.Add(timerKey{msgId: msgId}, timeout)
+		t.pmtx.Unlock()
+		t.timeoutDisplaced(displaced, msgId)
 	}
+	err = t.push(so, payload)
+	if err != nil {
+		// never sent, take back the state machine
+		t.t.Cancel(timerKey{msgId: msgId})
+		if t.statmachinePool.Pop(msgId) != nil {
+			t.release()
+			t.admitted(timerKey{msgId: msgId})
+		}
+		return timerKey{}, err
+	}
+	return timerKey{msgId: msgId}, nil
+}
 
-	for {
+// take back the request, its response is discarded and the state machine
+// is not called, e.g. the losing request of hedging
+func (t *Transport) cancel(key timerKey) {
+	var sm StatMachine
+	if t.pt.Multiplex {
+		sm = t.muxPool.Pop(key.reqId)
+	} else {
+		sm = t.statmachinePool.Pop(key.msgId)
+	}
 
-		select {
-		case now = <-tc.C:
-			fillq(now)
-			if index < 0 {
-				continue
-			}
-		case msgId := <-t.tq:
-			te := timeEntPool.Get().(*tentry)
-			te.msgId = msgId
-			te.timeout = time.Now().Add(t.pt.Timeout())
-			heap.Push(t.t, te)
-			continue
+	if sm == nil {
+		// responded or timed out
+		return
+	}
+
+	t.t.Cancel(key)
+	t.release()
+	t.admitted(key).cancel()
+}
+
+// take back the in-flight request of the reused msgId with its slots, the
+// caller holds pmtx and times out the returned state machine after unlock
+func (t *Transport) displace(msgId string) StatMachine {
+	sm := t.statmachinePool.Pop(msgId)
+	if sm == nil {
+		return nil
+	}
+
+	t.t.Cancel(timerKey{msgId: msgId})
+	t.release()
+	// not the failure of the backend
+	t.admitted(timerKey{msgId: msgId}).cancel()
+	return sm
+}
+
+func (t *Transport) timeoutDisplaced(sm StatMachine, msgId string) {
+	if sm == nil {
+		return
+	}
+
+	log.Printf("msgId:%s The state machine is displaced by the reused msgId", msgId)
+	t.executor.Timeout(sm, msgId)
+}
+
+// take the in-flight slots of the transport and of the TransportKey
+func (t *Transport) acquire(so *sendOptions) error {
+	if t.keyInflight != nil {
+		err := t.keyInflight.acquire(so.context(), t.pt.FailFastInFlight)
+		if err != nil {
+			return fmt.Errorf("key in-flight, %w", err)
 		}
+	}
 
-		for {
-			for i := int8(0); i <= index; i++ {
-				t.Timeout(q[i].msgId)
-				timeEntPool.Put(q[i])
-				q[i] = nil // help gc
+	if t.inflight != nil {
+		err := t.inflight.acquire(so.context(), t.pt.FailFastInFlight)
+		if err != nil {
+			if t.keyInflight != nil {
+				t.keyInflight.release()
 			}
-			index = -1
+			return fmt.Errorf("transport in-flight, %w", err)
+		}
+	}
+	return nil
+}
 
-			if overflow {
-				overflow = false
-				fillq(now)
-			}
+// the breaker follows the endpoint the channel is connected to, e.g. a
+// standby endpoint of HATCPTransportKey after the failover
+func (t *Transport) connected() {
+	if t.pt.CircuitBreaker == nil {
+		return
+	}
 
-			if index >= 0 {
-				continue
-			}
+	cb := t.pt.circuitBreaker(endpointKey(t.key, t.ch))
+	t.gmtx.Lock()
+	t.breaker = cb
+	t.gmtx.Unlock()
+}
 
-			break
+// admit the request by the breaker of the endpoint connected
+func (t *Transport) admit() (admission, error) {
+	t.gmtx.Lock()
+	cb := t.breaker
+	t.gmtx.Unlock()
+	return cb.admit()
+}
+
+// remember the admission of the request before it can be responded
+func (t *Transport) track(key timerKey, adm admission) {
+	if adm.cb == nil {
+		return
+	}
+
+	t.gmtx.Lock()
+	t.admissions[key] = adm
+	t.gmtx.Unlock()
+}
+
+// take the admission of the request, the zero one if no breaker admitted it
+func (t *Transport) admitted(key timerKey) admission {
+	if t.admissions == nil {
+		return admission{}
+	}
+
+	t.gmtx.Lock()
+	adm := t.admissions[key]
+	delete(t.admissions, key)
+	t.gmtx.Unlock()
+	return adm
+}
+
+// the outcome of the request to the circuit breaker which admitted it
+func (t *Transport) report(key timerKey, success bool) {
+	t.admitted(key).done(success)
+}
+
+func (t *Transport) release() {
+	if t.inflight != nil {
+		t.inflight.release()
+	}
+
+	if t.keyInflight != nil {
+		t.keyInflight.release()
+	}
+}
+
+// The time left of the request is stamped on the frame when it's written,
+// the time waited in the queue is not given to the server. The request
+// which timed out or was taken back meanwhile is not sent.
+func (t *Transport) stampDeadline(frame []byte) bool {
+	if !isFrameKind(frame, FRAME_REQUEST) || frame[1]&FRAME_FLAG_DEADLINE == 0 ||
+		len(frame) < FRAME_HEAD_BYTE_SIZE+FRAME_DEADLINE_BYTE_SIZE {
+		return true
+	}
+
+	deadline, ok := t.muxPool.Deadline(binary.BigEndian.Uint64(frame[2:FRAME_HEAD_BYTE_SIZE]))
+	if !ok {
+		return false
+	}
+	binary.BigEndian.PutUint32(frame[FRAME_HEAD_BYTE_SIZE:], encodeTimeout(time.Until(deadline)))
+	return true
+}
+
+func (t *Transport) push(so *sendOptions, payload []byte) error {
+	if pc, ok := t.edP.(PacketChecker); ok {
+		if err := pc.CheckPacket(payload); err != nil {
+			return err
 		}
+	}
 
-		if t.close {
-			break
+	if so.noWait {
+		if tp, ok := t.q.(PriorityTryPusher); ok {
+			return tp.TryPushPriority(payload, so.priority)
 		}
+		return t.q.TryPush(payload)
 	}
 
-	for msgId := range t.tq {
-		t.Timeout(msgId)
+	if pp, ok := t.q.(PriorityPusher); ok {
+		return pp.PushPriority(so.context(), payload, so.priority)
+	}
+	return t.q.PushContext(so.context(), payload)
+}
+
+func (t *Transport) startTimer() {
+	tc := time.NewTicker(TIMER_TICK)
+	var expired []timerKey
+	for now := range tc.C {
+		expired = t.t.Expire(now, expired[:0])
+		for i := range expired {
+			t.expire(expired[i])
+			expired[i] = timerKey{} // help gc
+		}
+
+		// wait for the in-flight requests until all of them are done
+		if t.close && t.t.Len() == 0 {
+			break
+		}
 	}
 
 	tc.Stop()
 }
 
 func (t *Transport) Process(payload []byte) {
+	var sm StatMachine
+	if t.pt.Multiplex {
+		sm = t.processMultiplex(payload)
+	} else {
+		sm = t.process(payload)
+	}
+
+	// SyncStatMachine hands the message over to the caller of SyncSend,
+	// which may still reference the buffer after Process returns
+	if _, ok := sm.(messageKeeper); !ok {
+		t.releasePacket(payload)
+	}
+}
+
+// return the state machine which processed the payload
+func (t *Transport) process(payload []byte) StatMachine {
 	v, msgId, err := t.edM.DecodeMessage(payload)
 	if err != nil {
 		log.Printf("msgId:%s decode, %s", msgId, err)
 		// leak sm? no, by timer gc
-		return
+		return nil
 	}
 
 	sm := t.statmachinePool.Pop(msgId)
 	if sm == nil {
 		// maybe timeout
 		log.Printf("msgId:%s maybe statmachine timeout", msgId)
-		return
+		return nil
 	}
+	t.t.Cancel(timerKey{msgId: msgId})
+	t.release()
+	t.report(timerKey{msgId: msgId}, responseSucceeded(v))
 
 	sm.Process(msgId, v)
+	return sm
+}
+
+func (t *Transport) processMultiplex(payload []byte) StatMachine {
+	h, body, err := decodeFrame(payload)
+	if err != nil {
+		log.Printf("client transport from %s, %s", t.ch.PeerInfo(), err)
+		return nil
+	}
+
+	var v interface{}
+	switch h.kind {
+	case FRAME_RESPONSE:
+		v, _, err = t.edM.DecodeMessage(body)
+	case FRAME_ERROR:
+		v, err = decodeRemoteError(body)
+	case FRAME_PONG:
+		// the receive loop has counted it
+		return nil
+	default:
+		log.Printf("reqId:%d unexpected frame kind:%d", h.reqId, h.kind)
+		return nil
+	}
+
+	if err != nil {
+		log.Printf("reqId:%d decode, %s", h.reqId, err)
+		// leak sm? no, by timer gc
+		return nil
+	}
+
+	sm := t.muxPool.Pop(h.reqId)
+	if sm == nil {
+		// maybe timeout
+		log.Printf("reqId:%d maybe statmachine timeout", h.reqId)
+		return nil
+	}
+	t.t.Cancel(timerKey{reqId: h.reqId})
+	t.release()
+	t.report(timerKey{reqId: h.reqId}, responseSucceeded(v))
+
+	if rerr, ok := v.(*RemoteError); ok {
+		if esm, ok := sm.(ErrorStatMachine); ok {
+			esm.ProcessError(formatReqId(h.reqId), rerr)
+			return sm
+		}
+	}
+
+	if msm, ok := sm.(MetadataStatMachine); ok {
+		msm.ProcessMetadata(formatReqId(h.reqId), h.md, v)
+	} else {
+		sm.Process(formatReqId(h.reqId), v)
+	}
+	return sm
+}
+
+func (t *Transport) releasePacket(payload []byte) {
+	if t.releaser != nil && payload != nil {
+		t.releaser.ReleasePacket(payload)
+	}
+}
+
+func (t *Transport) expire(key timerKey) {
+	if !t.pt.Multiplex {
+		t.Timeout(key.msgId)
+		return
+	}
+
+	sm := t.muxPool.Pop(key.reqId)
+	if sm == nil {
+		return
+	}
+	t.release()
+	t.report(key, false)
+	log.Printf("reqId:%d The state machine timed out ", key.reqId)
+	t.executor.Timeout(sm, formatReqId(key.reqId))
 }
 
 func (t *Transport) Timeout(msgId string) {
@@ -350,6 +737,8 @@ func (t *Transport) Timeout(msgId string) {
 	if sm == nil {
 		return
 	}
+	t.release()
+	t.report(timerKey{msgId: msgId}, false)
 	log.Printf("msgId:%s The state machine timed out ", msgId)
 	t.executor.Timeout(sm, msgId)
 }
@@ -0,0 +1,202 @@
+// The built-in EnDecMessage implementations, the body is serialized by a
+// BodyCodec (json, gob, protobuf) behind a standard header, so CmdMethoder
+// and the msgId extraction work without hand-written Serialize/Unserialize.
+//
+// format:
+//
+//	+--------+--------+---------------+-----------------+-------------+
+//	|  cmd   | flags  | msgId length  |      msgId      |    body     |
+//	+--------+--------+---------------+-----------------+-------------+
+//	| 4 byte | 2 byte |    2 byte     |  msgId length   | left bytes  |
+//	+--------+--------+---------------+-----------------+-------------+
+package listenrain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+)
+
+const (
+	CODEC_HEAD_BYTE_SIZE = 8
+)
+
+// The message of CodecEnDecMessage, Body is a pointer of the type registered for Command,
+// a nil Body is sent empty and decoded as the zero value of the type
+type CodecMessage struct {
+	Command int
+	Flags   uint16
+	MsgId   string
+	Body    interface{}
+}
+
+func (m *CodecMessage) Cmd() int {
+	return m.Command
+}
+
+// The response message of the same msgId
+func (m *CodecMessage) Reply(cmd int, body interface{}) *CodecMessage {
+	return &CodecMessage{
+		Command: cmd,
+		MsgId:   m.MsgId,
+		Body:    body,
+	}
+}
+
+type BodyCodec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type JSONBodyCodec struct{}
+
+func (JSONBodyCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONBodyCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type GobBodyCodec struct{}
+
+func (GobBodyCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobBodyCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Implemented by the generated protobuf messages (gogo/protobuf and the
+// like), other protobuf runtimes plug in through a BodyCodec wrapping
+// their Marshal/Unmarshal functions
+type ProtoMarshaler interface {
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+type ProtoBodyCodec struct{}
+
+func (ProtoBodyCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(ProtoMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a protobuf message", v)
+	}
+	return m.Marshal()
+}
+
+func (ProtoBodyCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(ProtoMarshaler)
+	if !ok {
+		return fmt.Errorf("%T is not a protobuf message", v)
+	}
+	return m.Unmarshal(data)
+}
+
+type CodecEnDecMessage struct {
+	codec BodyCodec
+	mtx   sync.RWMutex
+	types map[int]func() interface{}
+}
+
+func NewCodecEnDecMessage(codec BodyCodec) *CodecEnDecMessage {
+	return &CodecEnDecMessage{
+		codec: codec,
+		types: make(map[int]func() interface{}),
+	}
+}
+
+func NewJSONEnDecMessage() *CodecEnDecMessage {
+	return NewCodecEnDecMessage(JSONBodyCodec{})
+}
+
+func NewGobEnDecMessage() *CodecEnDecMessage {
+	return NewCodecEnDecMessage(GobBodyCodec{})
+}
+
+func NewProtoEnDecMessage() *CodecEnDecMessage {
+	return NewCodecEnDecMessage(ProtoBodyCodec{})
+}
+
+// newBody returns the pointer that the body of cmd is decoded into,
+// register before send or listen, on both side
+func (ed *CodecEnDecMessage) Register(cmd int, newBody func() interface{}) {
+	ed.mtx.Lock()
+	ed.types[cmd] = newBody
+	ed.mtx.Unlock()
+}
+
+func (ed *CodecEnDecMessage) EncodeMessage(message interface{}) (payload []byte, msgId string, err error) {
+	msg, ok := message.(*CodecMessage)
+	if !ok {
+		return nil, "", fmt.Errorf("not supported message type %T", message)
+	}
+
+	if len(msg.MsgId) > math.MaxUint16 {
+		return nil, "", fmt.Errorf("msgId size:%d exceeds the max:%d", len(msg.MsgId), math.MaxUint16)
+	}
+
+	var body []byte
+	if msg.Body != nil {
+		body, err = ed.codec.Marshal(msg.Body)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	payload = make([]byte, CODEC_HEAD_BYTE_SIZE+len(msg.MsgId)+len(body))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(msg.Command))
+	binary.BigEndian.PutUint16(payload[4:6], msg.Flags)
+	binary.BigEndian.PutUint16(payload[6:8], uint16(len(msg.MsgId)))
+	n := copy(payload[CODEC_HEAD_BYTE_SIZE:], msg.MsgId)
+	copy(payload[CODEC_HEAD_BYTE_SIZE+n:], body)
+	return payload, msg.MsgId, nil
+}
+
+func (ed *CodecEnDecMessage) DecodeMessage(payload []byte) (message interface{}, msgId string, err error) {
+	if len(payload) < CODEC_HEAD_BYTE_SIZE {
+		return nil, "", fmt.Errorf("payload is deformed for codec header, size:%d", len(payload))
+	}
+
+	msg := &CodecMessage{
+		Command: int(int32(binary.BigEndian.Uint32(payload[0:4]))),
+		Flags:   binary.BigEndian.Uint16(payload[4:6]),
+	}
+
+	idSize := int(binary.BigEndian.Uint16(payload[6:8]))
+	if CODEC_HEAD_BYTE_SIZE+idSize > len(payload) {
+		return nil, "", fmt.Errorf("codec header is deformed, msgId size:%d, payload size:%d", idSize, len(payload))
+	}
+	// deep copy, the payload buffer may be released
+	msg.MsgId = string(payload[CODEC_HEAD_BYTE_SIZE : CODEC_HEAD_BYTE_SIZE+idSize])
+
+	ed.mtx.RLock()
+	newBody := ed.types[msg.Command]
+	ed.mtx.RUnlock()
+	if newBody == nil {
+		return nil, msg.MsgId, fmt.Errorf("not registered cmd no:%d", msg.Command)
+	}
+
+	msg.Body = newBody()
+	body := payload[CODEC_HEAD_BYTE_SIZE+idSize:]
+	if len(body) == 0 {
+		// nil body, or the empty protobuf message
+		return msg, msg.MsgId, nil
+	}
+
+	err = ed.codec.Unmarshal(body, msg.Body)
+	if err != nil {
+		return nil, msg.MsgId, err
+	}
+	return msg, msg.MsgId, nil
+}
@@ -0,0 +1,153 @@
+package listenrain
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testBody struct {
+	Name string
+	Age  int
+}
+
+// the protobuf message of a single string field
+type testProtoBody struct {
+	Name string
+}
+
+func (b *testProtoBody) Marshal() ([]byte, error) {
+	return []byte(b.Name), nil
+}
+
+func (b *testProtoBody) Unmarshal(data []byte) error {
+	b.Name = string(data)
+	return nil
+}
+
+func TestCodecEnDecMessageRoundTrip(t *testing.T) {
+	cases := []struct {
+		edm  *CodecEnDecMessage
+		body interface{}
+	}{
+		{NewJSONEnDecMessage(), &testBody{Name: "rain", Age: 3}},
+		{NewGobEnDecMessage(), &testBody{Name: "rain", Age: 3}},
+		{NewProtoEnDecMessage(), &testProtoBody{Name: "rain"}},
+	}
+	for _, c := range cases {
+		typ := reflect.TypeOf(c.body).Elem()
+		c.edm.Register(7, func() interface{} { return reflect.New(typ).Interface() })
+
+		payload, msgId, err := c.edm.EncodeMessage(&CodecMessage{Command: 7, Flags: 2, MsgId: "id", Body: c.body})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msgId != "id" {
+			t.Fatalf("unexpected msgId %s", msgId)
+		}
+
+		v, msgId, err := c.edm.DecodeMessage(payload)
+		if err != nil {
+			t.Fatalf("%T, %v", c.edm.codec, err)
+		}
+
+		msg := v.(*CodecMessage)
+		if msgId != "id" || msg.MsgId != "id" || msg.Cmd() != 7 || msg.Flags != 2 {
+			t.Fatalf("%T, unexpected header %+v", c.edm.codec, msg)
+		}
+
+		if !reflect.DeepEqual(msg.Body, c.body) {
+			t.Fatalf("%T, expect %+v, got %+v", c.edm.codec, c.body, msg.Body)
+		}
+	}
+}
+
+// the nil body is decoded as the zero value, not passed to Unmarshal
+func TestCodecEnDecMessageNilBody(t *testing.T) {
+	for _, edm := range []*CodecEnDecMessage{NewJSONEnDecMessage(), NewGobEnDecMessage(), NewProtoEnDecMessage()} {
+		edm.Register(1, func() interface{} { return &testProtoBody{} })
+		payload, _, err := edm.EncodeMessage(&CodecMessage{Command: 1, MsgId: "id"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v, _, err := edm.DecodeMessage(payload)
+		if err != nil {
+			t.Fatalf("%T, %v", edm.codec, err)
+		}
+
+		if body := v.(*CodecMessage).Body; !reflect.DeepEqual(body, &testProtoBody{}) {
+			t.Fatalf("%T, expect the zero body, got %+v", edm.codec, body)
+		}
+	}
+}
+
+func TestCodecEnDecMessageErrors(t *testing.T) {
+	edm := NewJSONEnDecMessage()
+	if _, _, err := edm.EncodeMessage("plain"); err == nil {
+		t.Fatal("expect the error of the message type")
+	}
+
+	_, _, err := edm.EncodeMessage(&CodecMessage{MsgId: strings.Repeat("a", math.MaxUint16+1)})
+	if err == nil {
+		t.Fatal("expect the error of the msgId size")
+	}
+
+	if _, _, err := NewProtoEnDecMessage().EncodeMessage(&CodecMessage{Body: &testBody{}}); err == nil {
+		t.Fatal("expect the error of the protobuf message")
+	}
+
+	if _, _, err := edm.DecodeMessage(make([]byte, CODEC_HEAD_BYTE_SIZE-1)); err == nil {
+		t.Fatal("expect the error of the header size")
+	}
+
+	payload := make([]byte, CODEC_HEAD_BYTE_SIZE)
+	binary.BigEndian.PutUint16(payload[6:8], 1)
+	if _, _, err := edm.DecodeMessage(payload); err == nil {
+		t.Fatal("expect the error of the msgId size")
+	}
+
+	// not registered cmd, the msgId is still reported
+	payload, _, err = edm.EncodeMessage(&CodecMessage{Command: 9, MsgId: "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, msgId, err := edm.DecodeMessage(payload); err == nil || msgId != "id" {
+		t.Fatalf("expect the error of the cmd with the msgId, got %s, %v", msgId, err)
+	}
+
+	edm.Register(1, func() interface{} { return &testBody{} })
+	payload = append(make([]byte, CODEC_HEAD_BYTE_SIZE), '{')
+	binary.BigEndian.PutUint32(payload, 1)
+	if _, _, err := edm.DecodeMessage(payload); err == nil {
+		t.Fatal("expect the error of the body")
+	}
+}
+
+// the ack without body goes back to the caller
+func TestCodecSendNilBodyReply(t *testing.T) {
+	codec := func(pt *protocolType) {
+		edm := NewJSONEnDecMessage()
+		edm.Register(1, func() interface{} { return &testBody{} })
+		edm.Register(2, func() interface{} { return &testBody{} })
+		pt.EdM = edm
+	}
+	lr := NewListenRain(NewDefaultTransportPool())
+	key := testServer(t, func(response ServerResponse, msgId string, cmd int, message interface{}) error {
+		return response.Response(message.(*CodecMessage).Reply(2, nil))
+	}, codec)
+	ptyp := testClient(lr, codec)
+
+	v, err := lr.SyncSend(ptyp, key, &CodecMessage{Command: 1, MsgId: "id", Body: &testBody{Name: "rain"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := v.(*CodecMessage); msg.Cmd() != 2 || msg.MsgId != "id" {
+		t.Fatalf("unexpected response %+v", msg)
+	}
+}
@@ -0,0 +1,249 @@
+// The EnDecPacket decorator compressing the payload per frame, the frame
+// smaller than the threshold, or not smaller after compression, is sent raw.
+//
+// format:
+//
+//	+--------------------------------+--------------------------+
+//	|     (compressed) payload       |    compression flag      |
+//	+--------------------------------+--------------------------+
+//	|           left bytes           |         1 byte           |
+//	+--------------------------------+--------------------------+
+package listenrain
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+const (
+	COMPRESS_NONE uint8 = iota
+	COMPRESS_GZIP
+	COMPRESS_FLATE
+	// the flags from it on are free for the pluggable Compressors
+	COMPRESS_CUSTOM = 1 << 4
+)
+
+const (
+	DEFAULT_COMPRESS_THRESHOLD = 1 << 10 // 1KiB
+)
+
+// The pluggable compression algorithm
+type Compressor interface {
+	Compress(dst *bytes.Buffer, src []byte) error
+	NewReader(src io.Reader) (io.ReadCloser, error)
+}
+
+type GzipCompressor struct {
+	// gzip.DefaultCompression if 0
+	Level int
+	pool  sync.Pool
+}
+
+func (c *GzipCompressor) Compress(dst *bytes.Buffer, src []byte) error {
+	w, ok := c.pool.Get().(*gzip.Writer)
+	if ok {
+		w.Reset(dst)
+	} else {
+		level := c.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+
+		var err error
+		w, err = gzip.NewWriterLevel(dst, level)
+		if err != nil {
+			return err
+		}
+	}
+	defer c.pool.Put(w)
+
+	_, err := w.Write(src)
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func (c *GzipCompressor) NewReader(src io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(src)
+}
+
+type FlateCompressor struct {
+	// flate.DefaultCompression if 0
+	Level int
+	pool  sync.Pool
+}
+
+func (c *FlateCompressor) Compress(dst *bytes.Buffer, src []byte) error {
+	w, ok := c.pool.Get().(*flate.Writer)
+	if ok {
+		w.Reset(dst)
+	} else {
+		level := c.Level
+		if level == 0 {
+			level = flate.DefaultCompression
+		}
+
+		var err error
+		w, err = flate.NewWriter(dst, level)
+		if err != nil {
+			return err
+		}
+	}
+	defer c.pool.Put(w)
+
+	_, err := w.Write(src)
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func (c *FlateCompressor) NewReader(src io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(src), nil
+}
+
+type CompressEnDecPacket struct {
+	// the framing wrapped, such as DefaultEnDecPacket
+	EdP EnDecPacket
+	// the flag of the Compressor used on encode, COMPRESS_NONE disables the compression
+	Algorithm uint8
+	// frames smaller than it are sent raw, 0 means DEFAULT_COMPRESS_THRESHOLD
+	Threshold int
+	// Max size of the decompressed payload, 0 means DEFAULT_MAX_PACKET_SIZE,
+	// math.MaxUint32 means no limit
+	MaxPacketSize uint32
+
+	mtx        sync.RWMutex
+	compressor map[uint8]Compressor
+}
+
+func NewCompressEnDecPacket(edp EnDecPacket, algorithm uint8) *CompressEnDecPacket {
+	ed := &CompressEnDecPacket{
+		EdP:       edp,
+		Algorithm: algorithm,
+	}
+	ed.RegisterCompressor(COMPRESS_GZIP, &GzipCompressor{})
+	ed.RegisterCompressor(COMPRESS_FLATE, &FlateCompressor{})
+	return ed
+}
+
+// plug the Compressor in the slot of flag, to be the same on both side
+func (ed *CompressEnDecPacket) RegisterCompressor(flag uint8, c Compressor) {
+	ed.mtx.Lock()
+	if ed.compressor == nil {
+		ed.compressor = make(map[uint8]Compressor)
+	}
+	ed.compressor[flag] = c
+	ed.mtx.Unlock()
+}
+
+func (ed *CompressEnDecPacket) getCompressor(flag uint8) Compressor {
+	ed.mtx.RLock()
+	c := ed.compressor[flag]
+	ed.mtx.RUnlock()
+	return c
+}
+
+func (ed *CompressEnDecPacket) threshold() int {
+	if ed.Threshold == 0 {
+		return DEFAULT_COMPRESS_THRESHOLD
+	}
+	return ed.Threshold
+}
+
+func (ed *CompressEnDecPacket) compress(payload []byte) ([]byte, error) {
+	if ed.Algorithm != COMPRESS_NONE && len(payload) >= ed.threshold() {
+		c := ed.getCompressor(ed.Algorithm)
+		if c == nil {
+			return nil, fmt.Errorf("not registered compressor:%d", ed.Algorithm)
+		}
+
+		var buf bytes.Buffer
+		buf.Grow(len(payload)/2 + 1)
+		err := c.Compress(&buf, payload)
+		if err != nil {
+			return nil, err
+		}
+
+		if buf.Len() < len(payload) {
+			buf.WriteByte(ed.Algorithm)
+			return buf.Bytes(), nil
+		}
+	}
+
+	frame := make([]byte, len(payload)+1)
+	copy(frame, payload)
+	frame[len(payload)] = COMPRESS_NONE
+	return frame, nil
+}
+
+func (ed *CompressEnDecPacket) EncodePacket(w io.Writer, payload []byte) error {
+	frame, err := ed.compress(payload)
+	if err != nil {
+		return err
+	}
+	return ed.EdP.EncodePacket(w, frame)
+}
+
+func (ed *CompressEnDecPacket) AppendPacket(bufs net.Buffers, payload []byte) (net.Buffers, error) {
+	frame, err := ed.compress(payload)
+	if err != nil {
+		return bufs, err
+	}
+
+	return appendPacket(ed.EdP, bufs, frame)
+}
+
+func (ed *CompressEnDecPacket) DecodePacket(r io.Reader) ([]byte, error) {
+	buf, err := ed.EdP.DecodePacket(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("%w, frame without compression flag", ErrProtocolViolation)
+	}
+
+	size := len(buf) - 1
+	flag := buf[size]
+	if flag == COMPRESS_NONE {
+		return buf[:size], nil
+	}
+	defer ed.ReleasePacket(buf)
+
+	c := ed.getCompressor(flag)
+	if c == nil {
+		return nil, fmt.Errorf("%w, not registered compressor:%d", ErrProtocolViolation, flag)
+	}
+
+	zr, err := c.NewReader(bytes.NewReader(buf[:size]))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	// one more byte to tell the oversize payload
+	max := packetSizeLimit(ed.MaxPacketSize)
+	payload, err := ioutil.ReadAll(io.LimitReader(zr, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(payload)) > max {
+		return nil, &PacketSizeError{Size: uint64(len(payload)), Max: max}
+	}
+	return payload, nil
+}
+
+func (ed *CompressEnDecPacket) ReleasePacket(buf []byte) {
+	if releaser, ok := ed.EdP.(PacketBufferReleaser); ok && buf != nil {
+		releaser.ReleasePacket(buf)
+	}
+}
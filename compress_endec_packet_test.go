@@ -0,0 +1,120 @@
+package listenrain
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func testCompressRoundTrip(t *testing.T, edp *CompressEnDecPacket, payload []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := edp.EncodePacket(&buf, payload); err != nil {
+		t.Fatal(err)
+	}
+	frame := append([]byte(nil), buf.Bytes()...)
+
+	p, err := edp.DecodePacket(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(p, payload) {
+		t.Fatalf("unexpected payload of %d bytes", len(p))
+	}
+	return frame
+}
+
+func TestCompressEnDecPacketRoundTrip(t *testing.T) {
+	large := []byte(strings.Repeat("hello listenrain ", 1000))
+	for _, algorithm := range []uint8{COMPRESS_GZIP, COMPRESS_FLATE} {
+		edp := NewCompressEnDecPacket(&DefaultEnDecPacket{}, algorithm)
+		frame := testCompressRoundTrip(t, edp, large)
+		if len(frame) >= len(large) || frame[len(frame)-1] != algorithm {
+			t.Fatalf("algorithm:%d, expect the compressed frame, got %d bytes", algorithm, len(frame))
+		}
+
+		// smaller than the threshold, sent raw
+		frame = testCompressRoundTrip(t, edp, []byte("hello"))
+		if frame[len(frame)-1] != COMPRESS_NONE {
+			t.Fatalf("algorithm:%d, expect the raw frame", algorithm)
+		}
+	}
+}
+
+// a flag of the custom range, upper cases the payload on the wire
+type upperCompressor struct{}
+
+func (upperCompressor) Compress(dst *bytes.Buffer, src []byte) error {
+	// never larger, so that it's always used
+	dst.Write(bytes.ToUpper(src[:len(src)-1]))
+	return nil
+}
+
+func (upperCompressor) NewReader(src io.Reader) (io.ReadCloser, error) {
+	b, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(bytes.ToLower(b))), nil
+}
+
+func TestCompressEnDecPacketCustomCompressor(t *testing.T) {
+	edp := &CompressEnDecPacket{EdP: &DefaultEnDecPacket{}, Algorithm: COMPRESS_CUSTOM, Threshold: 1}
+	edp.RegisterCompressor(COMPRESS_CUSTOM, upperCompressor{})
+
+	var buf bytes.Buffer
+	if err := edp.EncodePacket(&buf, []byte("hello!")); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := edp.DecodePacket(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(p) != "hello" {
+		t.Fatalf("unexpected payload %q", p)
+	}
+
+	// the receiver without the compressor
+	buf.Reset()
+	edp.EncodePacket(&buf, []byte("hello!"))
+	_, err = NewCompressEnDecPacket(&DefaultEnDecPacket{}, COMPRESS_NONE).DecodePacket(&buf)
+	if !errors.Is(err, ErrProtocolViolation) {
+		t.Fatalf("expect ErrProtocolViolation, got %v", err)
+	}
+}
+
+func TestCompressEnDecPacketMaxSize(t *testing.T) {
+	cases := []struct {
+		max   uint32
+		limit uint64
+	}{
+		{1 << 10, 1 << 10},
+		// 0 means the default limit, the decompression bomb is stopped by it
+		{0, DEFAULT_MAX_PACKET_SIZE},
+	}
+	for _, c := range cases {
+		if c.max == 0 && testing.Short() {
+			t.Skip("compressing the payload of the default limit")
+		}
+
+		enc := NewCompressEnDecPacket(&DefaultEnDecPacket{}, COMPRESS_FLATE)
+		var buf bytes.Buffer
+		if err := enc.EncodePacket(&buf, make([]byte, c.limit+1)); err != nil {
+			t.Fatal(err)
+		}
+
+		dec := NewCompressEnDecPacket(&DefaultEnDecPacket{}, COMPRESS_FLATE)
+		dec.MaxPacketSize = c.max
+		_, err := dec.DecodePacket(&buf)
+		var sizeErr *PacketSizeError
+		if !errors.As(err, &sizeErr) || sizeErr.Max != c.limit || !errors.Is(err, ErrProtocolViolation) {
+			t.Fatalf("max:%d, expect the limit of %d, got %v", c.max, c.limit, err)
+		}
+	}
+}
@@ -4,25 +4,92 @@
 package listenrain
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net"
 
 	"encoding/binary"
 )
 
 const (
 	DEFAULT_PACKET_HEAD_BYTE_SIZE = 4
+	DEFAULT_MAX_PACKET_SIZE       = 1 << 26 // 64MiB
 )
 
+var (
+	// The peer breaks the framing rules, the connection should be closed
+	ErrProtocolViolation = errors.New("protocol violation")
+	ErrPacketTooLarge    = errors.New("packet too large")
+	// The framing can't carry the payload, such as the text framing with a
+	// payload containing the delimiter
+	ErrInvalidPayload = errors.New("invalid payload")
+)
+
+type PacketSizeError struct {
+	Size uint64
+	Max  uint64
+}
+
+func (e *PacketSizeError) Error() string {
+	return fmt.Sprintf("packet size:%d exceeds the max:%d", e.Size, e.Max)
+}
+
+func (e *PacketSizeError) Is(target error) bool {
+	return target == ErrPacketTooLarge || target == ErrProtocolViolation
+}
+
+// the limit of the MaxPacketSize option, 0 means DEFAULT_MAX_PACKET_SIZE
+func packetSizeLimit(max uint32) uint64 {
+	if max == 0 {
+		return DEFAULT_MAX_PACKET_SIZE
+	}
+	return uint64(max)
+}
+
+// The payload which can't be encoded whatever the connection is, such as an
+// oversize one, is dropped by the sender rather than breaking the connection,
+// which would send it again after recover. Its request times out, unless the
+// EnDecPacket implements PacketChecker to fail it on Send. Return the error
+// left to the connection.
+func dropUnencodable(err error) error {
+	if errors.Is(err, ErrPacketTooLarge) || errors.Is(err, ErrInvalidPayload) {
+		log.Printf("drop the payload which can't be encoded, %s", err)
+		return nil
+	}
+	return err
+}
+
 func defaultAllocatePacketBuffer(size uint32) ([]byte, error) {
 	return make([]byte, size), nil
 }
 
 type DefaultEnDecPacket struct {
 	AllocatePacketBuffer func(size uint32) ([]byte, error)
+	// takes back the buffer of AllocatePacketBuffer, see PacketBufferReleaser
+	ReleasePacketBuffer func(buf []byte)
+	// Max payload size of both encode and decode, 0 means DEFAULT_MAX_PACKET_SIZE,
+	// math.MaxUint32 means no limit
+	MaxPacketSize uint32
+}
+
+func (ed *DefaultEnDecPacket) checkSize(size uint64) error {
+	if max := packetSizeLimit(ed.MaxPacketSize); size > max {
+		return &PacketSizeError{Size: size, Max: max}
+	}
+	return nil
+}
+
+func (ed *DefaultEnDecPacket) CheckPacket(payload []byte) error {
+	return ed.checkSize(uint64(len(payload)))
 }
 
 func (ed *DefaultEnDecPacket) EncodePacket(w io.Writer, payload []byte) error {
+	if err := ed.checkSize(uint64(len(payload))); err != nil {
+		return err
+	}
+
 	var (
 		length uint32 = uint32(len(payload))
 		head   [DEFAULT_PACKET_HEAD_BYTE_SIZE]byte
@@ -51,6 +118,22 @@ func (ed *DefaultEnDecPacket) EncodePacket(w io.Writer, payload []byte) error {
 	return nil
 }
 
+func (ed *DefaultEnDecPacket) AppendPacket(bufs net.Buffers, payload []byte) (net.Buffers, error) {
+	if err := ed.checkSize(uint64(len(payload))); err != nil {
+		return bufs, err
+	}
+
+	head := make([]byte, DEFAULT_PACKET_HEAD_BYTE_SIZE)
+	binary.BigEndian.PutUint32(head, uint32(len(payload)))
+	return append(bufs, head, payload), nil
+}
+
+func (ed *DefaultEnDecPacket) ReleasePacket(buf []byte) {
+	if ed.ReleasePacketBuffer != nil {
+		ed.ReleasePacketBuffer(buf)
+	}
+}
+
 func (ed *DefaultEnDecPacket) DecodePacket(r io.Reader) ([]byte, error) {
 	var head [DEFAULT_PACKET_HEAD_BYTE_SIZE]byte
 	n, err := io.ReadFull(r, head[:])
@@ -67,17 +150,24 @@ func (ed *DefaultEnDecPacket) DecodePacket(r io.Reader) ([]byte, error) {
 		return nil, nil
 	}
 
-	if ed.AllocatePacketBuffer == nil {
-		ed.AllocatePacketBuffer = defaultAllocatePacketBuffer
+	if err := ed.checkSize(uint64(size)); err != nil {
+		return nil, err
+	}
+
+	// the EnDecPacket is shared by the connections, don't set the default on it
+	allocate := ed.AllocatePacketBuffer
+	if allocate == nil {
+		allocate = defaultAllocatePacketBuffer
 	}
 
-	buf, err := ed.AllocatePacketBuffer(size)
+	buf, err := allocate(size)
 	if err != nil {
 		return nil, err
 	}
 
 	n, err = io.ReadFull(r, buf)
 	if err != nil {
+		ed.ReleasePacket(buf)
 		return nil, err
 	}
 
@@ -0,0 +1,158 @@
+package listenrain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDefaultEnDecPacketRoundTrip(t *testing.T) {
+	edp := &DefaultEnDecPacket{}
+	var buf bytes.Buffer
+	for _, p := range []string{"a", "hello"} {
+		if err := edp.EncodePacket(&buf, []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, expect := range []string{"a", "hello"} {
+		p, err := edp.DecodePacket(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(p) != expect {
+			t.Fatalf("expect %s, got %s", expect, p)
+		}
+	}
+}
+
+func TestDefaultEnDecPacketMaxSize(t *testing.T) {
+	cases := []struct {
+		max   uint32
+		limit uint64
+	}{
+		// 0 means the default limit
+		{0, DEFAULT_MAX_PACKET_SIZE},
+		{8, 8},
+	}
+	for _, c := range cases {
+		edp := &DefaultEnDecPacket{MaxPacketSize: c.max}
+		var head [DEFAULT_PACKET_HEAD_BYTE_SIZE]byte
+		binary.BigEndian.PutUint32(head[:], uint32(c.limit)+1)
+
+		_, err := edp.DecodePacket(bytes.NewReader(head[:]))
+		var sizeErr *PacketSizeError
+		if !errors.As(err, &sizeErr) || sizeErr.Max != c.limit {
+			t.Fatalf("max:%d, expect the limit of %d, got %v", c.max, c.limit, err)
+		}
+
+		if !errors.Is(err, ErrProtocolViolation) {
+			t.Fatalf("max:%d, the oversize frame is a protocol violation, got %v", c.max, err)
+		}
+	}
+
+	edp := &DefaultEnDecPacket{MaxPacketSize: 8}
+	if err := edp.EncodePacket(&bytes.Buffer{}, make([]byte, 9)); !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatalf("expect ErrPacketTooLarge, got %v", err)
+	}
+
+	if _, err := edp.AppendPacket(nil, make([]byte, 9)); !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatalf("expect ErrPacketTooLarge, got %v", err)
+	}
+}
+
+func TestDropUnencodable(t *testing.T) {
+	if err := dropUnencodable(&PacketSizeError{Size: 9, Max: 8}); err != nil {
+		t.Fatalf("expect the oversize payload dropped, got %v", err)
+	}
+
+	broken := errors.New("broken pipe")
+	if err := dropUnencodable(broken); err != broken {
+		t.Fatalf("expect the error of the connection kept, got %v", err)
+	}
+}
+
+// the checked payload fails Send at once, the connection goes on
+func TestSendRejectsOversizePayload(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	key := testServer(t, testEchoRouter, nil)
+	ptyp := testClient(lr, func(pt *protocolType) {
+		pt.EdP = &DefaultEnDecPacket{MaxPacketSize: 8}
+	})
+
+	sm := newTestStatMachine()
+	if err := lr.Send(ptyp, sm, key, "big:0123456789"); !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatalf("expect ErrPacketTooLarge, got %v", err)
+	}
+
+	v, err := lr.SyncSend(ptyp, key, "a:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != "a:1" {
+		t.Fatalf("unexpected response %v", v)
+	}
+}
+
+// the sender drops the oversize payload the EnDecPacket doesn't check before
+// it's queued, the connection goes on with the next one
+func TestSenderDropsOversizePayload(t *testing.T) {
+	for _, batch := range []int{0, 16} {
+		lr := NewListenRain(NewDefaultTransportPool())
+		key := testServer(t, testEchoRouter, func(pt *protocolType) {
+			pt.EdP = NewChecksumEnDecPacket(&DefaultEnDecPacket{})
+		})
+		ptyp := testClient(lr, func(pt *protocolType) {
+			// the checksum trailer makes the frame oversize
+			pt.EdP = NewChecksumEnDecPacket(&DefaultEnDecPacket{MaxPacketSize: 8})
+			pt.MaxBatchSize = batch
+		})
+
+		sm := newTestStatMachine()
+		if err := lr.Send(ptyp, sm, key, "big:0123", WithTimeout(100*time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := lr.SyncSend(ptyp, key, "a:1")
+		if err != nil {
+			t.Fatalf("batch:%d, %v", batch, err)
+		}
+
+		if v != "a:1" {
+			t.Fatalf("batch:%d, unexpected response %v", batch, v)
+		}
+
+		select {
+		case msgId := <-sm.timeouts:
+			if msgId != "big" {
+				t.Fatalf("unexpected msgId %s", msgId)
+			}
+		case <-time.After(testTimeout()):
+			t.Fatal("the dropped request doesn't time out")
+		}
+	}
+}
+
+// the buffer of the truncated body is given back
+func TestDefaultEnDecPacketReleasesTruncatedBody(t *testing.T) {
+	var released [][]byte
+	edp := &DefaultEnDecPacket{}
+	edp.ReleasePacketBuffer = func(buf []byte) {
+		released = append(released, buf)
+	}
+
+	var head [DEFAULT_PACKET_HEAD_BYTE_SIZE]byte
+	binary.BigEndian.PutUint32(head[:], 8)
+	r := bytes.NewReader(append(head[:], "abc"...))
+	if _, err := edp.DecodePacket(r); err == nil {
+		t.Fatal("expect the error of the truncated body")
+	}
+
+	if len(released) != 1 || len(released[0]) != 8 {
+		t.Fatalf("expect the buffer of 8 bytes released, got %d buffers", len(released))
+	}
+}
@@ -1,6 +1,8 @@
 package listenrain
 
 import (
+	"context"
+	"log"
 	"time"
 )
 
@@ -15,8 +17,13 @@ type DefaultQueue struct {
 	lastPopCount int
 }
 
+// cap <= 0 means DEFAULT_QUEUE_CAP, the cap larger than MAX_QUEUE_CAP is
+// capped to MAX_QUEUE_CAP, use BoundedQueue for a larger or byte-based limit
 func NewDefaultQueue(cap int) *DefaultQueue {
 	if cap > MAX_QUEUE_CAP {
+		log.Printf("default queue cap:%d exceeds the max, use %d", cap, MAX_QUEUE_CAP)
+		cap = MAX_QUEUE_CAP
+	} else if cap <= 0 {
 		cap = DEFAULT_QUEUE_CAP
 	}
 
@@ -35,10 +42,67 @@ func (q *DefaultQueue) Push(payload []byte) {
 	q.q <- payload
 }
 
+func (q *DefaultQueue) TryPush(payload []byte) error {
+	select {
+	case q.q <- payload:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+func (q *DefaultQueue) PushContext(ctx context.Context, payload []byte) error {
+	select {
+	case q.q <- payload:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (q *DefaultQueue) Pop() (payload []byte) {
 	return <-q.q
 }
 
+func (q *DefaultQueue) PopBatch(buf [][]byte, latency time.Duration) int {
+	p, ok := <-q.q
+	if !ok {
+		return 0
+	}
+	buf[0] = p
+
+	var deadline <-chan time.Time
+	if latency > 0 {
+		t := time.NewTimer(latency)
+		defer t.Stop()
+		deadline = t.C
+	}
+
+	n := 1
+	for n < len(buf) {
+		select {
+		case p, ok = <-q.q:
+		default:
+			if deadline == nil {
+				return n
+			}
+
+			select {
+			case p, ok = <-q.q:
+			case <-deadline:
+				return n
+			}
+		}
+
+		if !ok {
+			return n
+		}
+		buf[n] = p
+		n++
+	}
+	return n
+}
+
 // What's the problem with implementation?
 func (q *DefaultQueue) PopNoBlocking() (payload []byte) {
 	if q.ticker == nil {
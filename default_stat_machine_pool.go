@@ -16,6 +16,16 @@ func (p *DefaultStatMachinePool) Put(msgId string, sm StatMachine) {
 	p.mtx.Unlock()
 }
 
+func (p *DefaultStatMachinePool) TryPut(msgId string, sm StatMachine) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if _, exist := p.c[msgId]; exist {
+		return ErrDuplicateMsgId
+	}
+	p.c[msgId] = sm
+	return nil
+}
+
 func (p *DefaultStatMachinePool) Pop(msgId string) StatMachine {
 	p.mtx.Lock()
 	sm := p.c[msgId]
@@ -24,6 +34,13 @@ func (p *DefaultStatMachinePool) Pop(msgId string) StatMachine {
 	return sm
 }
 
+func (p *DefaultStatMachinePool) Len() int {
+	p.mtx.Lock()
+	n := len(p.c)
+	p.mtx.Unlock()
+	return n
+}
+
 func DefaultStatMachinePoolGenerator(key TransportKey) (StatMachinePool, error) {
 	return &DefaultStatMachinePool{
 		c: make(map[string]StatMachine),
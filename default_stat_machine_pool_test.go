@@ -0,0 +1,57 @@
+package listenrain
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDefaultStatMachinePoolTryPut(t *testing.T) {
+	p, _ := DefaultStatMachinePoolGenerator(nil)
+	up := p.(UniqueStatMachinePool)
+	sm := newTestStatMachine()
+	if err := up.TryPut("a", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := up.TryPut("a", sm); !errors.Is(err, ErrDuplicateMsgId) {
+		t.Fatalf("expect ErrDuplicateMsgId, got %v", err)
+	}
+
+	if up.Pop("a") != sm {
+		t.Fatal("lost the first state machine")
+	}
+
+	if err := up.TryPut("a", sm); err != nil {
+		t.Fatalf("msgId is reusable after Pop, %v", err)
+	}
+}
+
+func TestSendRejectsInFlightMsgId(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	key := testServer(t, func(response ServerResponse, msgId string, cmd int, message interface{}) error {
+		time.Sleep(200 * time.Millisecond)
+		return response.Response(message)
+	}, nil)
+	ptyp := testClient(lr, nil)
+
+	sm := newTestStatMachine()
+	if err := lr.Send(ptyp, sm, key, "a:1"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := lr.Send(ptyp, newTestStatMachine(), key, "a:2")
+	if !errors.Is(err, ErrDuplicateMsgId) {
+		t.Fatalf("expect ErrDuplicateMsgId, got %v", err)
+	}
+
+	// the first request still gets its own response
+	select {
+	case v := <-sm.results:
+		if v != "a:1" {
+			t.Fatalf("unexpected response %v", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the first request is orphaned")
+	}
+}
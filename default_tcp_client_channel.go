@@ -52,14 +52,37 @@ func (tc *TcpChannel) IsActive() bool {
 	return tc.RemoteAddr() != nil
 }
 
+func (tc *TcpChannel) NetConn() net.Conn {
+	return tc.Conn
+}
+
 func (tc *TcpChannel) PeerInfo() string {
 	addr := tc.RemoteAddr()
 	return fmt.Sprintf("%s:%s", addr.Network(), addr.String())
 }
 
+// Enable the TCP keepalive probes every period, period < 0 disables them
+func (tc *TcpChannel) SetKeepAlive(period time.Duration) error {
+	c, ok := tc.Conn.(*net.TCPConn)
+	if !ok {
+		return errors.New("not a tcp connection")
+	}
+
+	if period < 0 {
+		return c.SetKeepAlive(false)
+	}
+
+	if err := c.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return c.SetKeepAlivePeriod(period)
+}
+
 type TcpClientChannelGenerator struct {
 	net.Addr
 	key string
+	// the keepalive period of the dialed connections, see net.Dialer.KeepAlive
+	keepAlive time.Duration
 }
 
 func NewTcpClientChannelGeneratorV2(key TransportKey) (ChannelGenerator, error) {
@@ -72,6 +95,25 @@ func NewTcpClientChannelGeneratorV2(key TransportKey) (ChannelGenerator, error)
 	return nil, errors.New("no supported tcp transport key type")
 }
 
+// Like NewTcpClientChannelGeneratorV2, dialing the connections with the
+// TCP keepalive period, period < 0 disables the keepalive
+func NewKeepAliveTcpClientChannelGenerator(period time.Duration) func(TransportKey) (ChannelGenerator, error) {
+	return func(key TransportKey) (ChannelGenerator, error) {
+		g, err := NewTcpClientChannelGeneratorV2(key)
+		if err != nil {
+			return nil, err
+		}
+
+		switch tcg := g.(type) {
+		case *TcpClientChannelGenerator:
+			tcg.keepAlive = period
+		case *HATcpClientChannelGenerator:
+			tcg.keepAlive = period
+		}
+		return g, nil
+	}
+}
+
 func NewTcpClientChannelGenerator(ip string, port int) (ChannelGenerator, error) {
 	address := fmt.Sprintf("%s:%d", ip, port)
 	addr, err := net.ResolveTCPAddr("tcp", address)
@@ -86,7 +128,8 @@ func NewTcpClientChannelGenerator(ip string, port int) (ChannelGenerator, error)
 }
 
 func (tcg *TcpClientChannelGenerator) Next() (Channel, error) {
-	c, err := net.DialTimeout(tcg.Addr.Network(), tcg.Addr.String(), 10*time.Second)
+	d := net.Dialer{Timeout: 10 * time.Second, KeepAlive: tcg.keepAlive}
+	c, err := d.Dial(tcg.Addr.Network(), tcg.Addr.String())
 	if err != nil {
 		return nil, err
 	}
@@ -165,6 +208,8 @@ type HATcpClientChannelGenerator struct {
 	key   *HATCPTransportKey
 	addrs []net.Addr
 	point int
+	// the keepalive period of the dialed connections, see net.Dialer.KeepAlive
+	keepAlive time.Duration
 }
 
 func NewHATcpClientChannelGenerator(key *HATCPTransportKey) (ChannelGenerator, error) {
@@ -204,9 +249,9 @@ func (hatcg *HATcpClientChannelGenerator) Next() (Channel, error) {
 		break
 	}
 
-	c, err := net.DialTimeout(hatcg.addrs[hatcg.point].Network(),
-		hatcg.addrs[hatcg.point].String(),
-		10*time.Second)
+	d := net.Dialer{Timeout: 10 * time.Second, KeepAlive: hatcg.keepAlive}
+	c, err := d.Dial(hatcg.addrs[hatcg.point].Network(),
+		hatcg.addrs[hatcg.point].String())
 	if err != nil {
 		return nil, err
 	}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"time"
 )
 
 const (
@@ -21,9 +22,25 @@ func NewTcpServerChannleGenerator(key TransportKey) (ChannelGenerator, error) {
 	return nil, errors.New("no supported tcp transport key type")
 }
 
+// Like NewTcpServerChannleGenerator, setting the TCP keepalive period of
+// the accepted connections, period < 0 disables the keepalive
+func NewKeepAliveTcpServerChannelGenerator(period time.Duration) func(TransportKey) (ChannelGenerator, error) {
+	return func(key TransportKey) (ChannelGenerator, error) {
+		g, err := NewTcpServerChannleGenerator(key)
+		if err != nil {
+			return nil, err
+		}
+
+		g.(*TcpServerChannelGenerator).keepAlive = period
+		return g, nil
+	}
+}
+
 type TcpServerChannelGenerator struct {
 	net.Listener
 	key string
+	// the keepalive period of the accepted connections, 0 keeps the default of net.Listen
+	keepAlive time.Duration
 }
 
 func (tcg *TcpServerChannelGenerator) listen(ip string, port int) error {
@@ -62,7 +79,13 @@ func (tcg *TcpServerChannelGenerator) Next() (Channel, error) {
 			return nil, err
 		}
 
-		return &TcpChannel{c}, nil
+		tc := &TcpChannel{c}
+		if tcg.keepAlive != 0 {
+			if err := tc.SetKeepAlive(tcg.keepAlive); err != nil {
+				log.Printf("TcpServerChannelGenerator set keepalive, %s", err)
+			}
+		}
+		return tc, nil
 	}
 }
 
@@ -0,0 +1,140 @@
+// The framing of text protocols, each packet ends with the delimiter,
+// a newline by default.
+package listenrain
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+var (
+	ErrDelimiterInPayload = fmt.Errorf("%w, payload contains the delimiter", ErrInvalidPayload)
+	// The binary frames may contain the delimiter anywhere, such as the
+	// request id of Multiplex or the trailer of ChecksumEnDecPacket
+	ErrBinaryOverDelimiter = errors.New("binary frames over the delimiter framing")
+)
+
+// check the framing is able to carry the binary frames of Multiplex and
+// of the wrappers
+func checkBinaryFraming(edp EnDecPacket, binary bool) error {
+	switch ed := edp.(type) {
+	case *ChecksumEnDecPacket:
+		return checkBinaryFraming(ed.EdP, true)
+	case *CompressEnDecPacket:
+		return checkBinaryFraming(ed.EdP, true)
+	case *DelimiterEnDecPacket:
+		if binary {
+			return ErrBinaryOverDelimiter
+		}
+	}
+	return nil
+}
+
+// The decoded payload doesn't contain the delimiter, its buffer is grown
+// on reading, so AllocatePacketBuffer is not used
+type DelimiterEnDecPacket struct {
+	PacketOptions
+	// nil means "\n"
+	Delimiter []byte
+}
+
+func (ed *DelimiterEnDecPacket) delimiter() []byte {
+	if len(ed.Delimiter) == 0 {
+		return []byte{'\n'}
+	}
+	return ed.Delimiter
+}
+
+func (ed *DelimiterEnDecPacket) CheckPacket(payload []byte) error {
+	if err := ed.checkSize(uint64(len(payload))); err != nil {
+		return err
+	}
+
+	if bytes.Contains(payload, ed.delimiter()) {
+		return ErrDelimiterInPayload
+	}
+	return nil
+}
+
+func (ed *DelimiterEnDecPacket) EncodePacket(w io.Writer, payload []byte) error {
+	if err := ed.CheckPacket(payload); err != nil {
+		return err
+	}
+
+	err := writeFull(w, payload)
+	if err != nil {
+		return err
+	}
+	return writeFull(w, ed.delimiter())
+}
+
+func (ed *DelimiterEnDecPacket) AppendPacket(bufs net.Buffers, payload []byte) (net.Buffers, error) {
+	if err := ed.CheckPacket(payload); err != nil {
+		return bufs, err
+	}
+	return append(bufs, payload, ed.delimiter()), nil
+}
+
+// the tail of buf may be the beginning of the delimiter
+func (ed *DelimiterEnDecPacket) checkPartial(buf, delim []byte) error {
+	size := len(buf)
+	if size >= len(delim) {
+		size -= len(delim) - 1
+	}
+	return ed.checkSize(uint64(size))
+}
+
+func (ed *DelimiterEnDecPacket) DecodePacket(r io.Reader) ([]byte, error) {
+	var (
+		delim = ed.delimiter()
+		last  = delim[len(delim)-1]
+		buf   []byte
+	)
+
+	if br, ok := r.(*bufio.Reader); ok {
+		// fast path, scan the buffered bytes
+		for {
+			chunk, err := br.ReadSlice(last)
+			buf = append(buf, chunk...)
+			if err == nil && bytes.HasSuffix(buf, delim) {
+				break
+			}
+
+			if err != nil && err != bufio.ErrBufferFull {
+				return nil, err
+			}
+
+			if err := ed.checkPartial(buf, delim); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		byteReader := asByteReader(r)
+		for {
+			b, err := byteReader.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+
+			buf = append(buf, b)
+			if b == last && bytes.HasSuffix(buf, delim) {
+				break
+			}
+
+			if err := ed.checkPartial(buf, delim); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// the whole frame may be found in the buffered bytes at once
+	buf = buf[:len(buf)-len(delim)]
+	if err := ed.checkSize(uint64(len(buf))); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,124 @@
+package listenrain
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestDelimiterEnDecPacketRoundTrip(t *testing.T) {
+	edp := &DelimiterEnDecPacket{Delimiter: []byte("\r\n")}
+	var buf bytes.Buffer
+	for _, p := range []string{"a\rb", "hello", ""} {
+		if err := edp.EncodePacket(&buf, []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the buffered reader and the bytes read one by one
+	for _, rd := range []io.Reader{
+		bufio.NewReaderSize(bytes.NewReader(buf.Bytes()), 16),
+		&plainReader{bytes.NewReader(buf.Bytes())},
+	} {
+		for _, expect := range []string{"a\rb", "hello", ""} {
+			p, err := edp.DecodePacket(rd)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(p) != expect {
+				t.Fatalf("expect %q, got %q", expect, p)
+			}
+		}
+	}
+}
+
+// hides the io.ByteReader of the reader
+type plainReader struct {
+	r *bytes.Reader
+}
+
+func (p *plainReader) Read(b []byte) (int, error) {
+	return p.r.Read(b)
+}
+
+func TestDelimiterEnDecPacketInvalidPayload(t *testing.T) {
+	edp := &DelimiterEnDecPacket{}
+	err := edp.EncodePacket(&bytes.Buffer{}, []byte("a\nb"))
+	if !errors.Is(err, ErrDelimiterInPayload) || !errors.Is(err, ErrInvalidPayload) {
+		t.Fatalf("expect ErrInvalidPayload, got %v", err)
+	}
+
+	if err := dropUnencodable(err); err != nil {
+		t.Fatalf("expect the payload dropped, got %v", err)
+	}
+}
+
+func TestDelimiterEnDecPacketMaxSize(t *testing.T) {
+	edp := &DelimiterEnDecPacket{PacketOptions: PacketOptions{MaxPacketSize: 4}}
+	rd := bufio.NewReaderSize(bytes.NewReader([]byte("0123456789\n")), 16)
+	if _, err := edp.DecodePacket(rd); !errors.Is(err, ErrProtocolViolation) {
+		t.Fatalf("expect ErrProtocolViolation, got %v", err)
+	}
+}
+
+func TestCheckBinaryFraming(t *testing.T) {
+	delim := &DelimiterEnDecPacket{}
+	cases := []struct {
+		edp       EnDecPacket
+		multiplex bool
+		err       error
+	}{
+		{delim, false, nil},
+		{delim, true, ErrBinaryOverDelimiter},
+		{NewChecksumEnDecPacket(delim), false, ErrBinaryOverDelimiter},
+		{&CompressEnDecPacket{EdP: delim}, false, ErrBinaryOverDelimiter},
+		{NewChecksumEnDecPacket(&DefaultEnDecPacket{}), true, nil},
+	}
+	for i, c := range cases {
+		pt := &protocolType{EdP: c.edp, Multiplex: c.multiplex}
+		if err := pt.validate(); err != c.err {
+			t.Errorf("case %d, expect %v, got %v", i, c.err, err)
+		}
+	}
+}
+
+func TestSendRejectsDelimiterInPayload(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	delim := func(pt *protocolType) {
+		pt.EdP = &DelimiterEnDecPacket{}
+	}
+	key := testServer(t, testEchoRouter, delim)
+	ptyp := testClient(lr, delim)
+
+	if _, err := lr.SyncSend(ptyp, key, "a:1\n2"); !errors.Is(err, ErrInvalidPayload) {
+		t.Fatalf("expect ErrInvalidPayload, got %v", err)
+	}
+
+	v, err := lr.SyncSend(ptyp, key, "b:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != "b:2" {
+		t.Fatalf("unexpected response %v", v)
+	}
+}
+
+func TestMultiplexOverDelimiterRejected(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	ptyp := testClient(lr, func(pt *protocolType) {
+		pt.EdP = &DelimiterEnDecPacket{}
+		pt.Multiplex = true
+	})
+
+	if _, err := lr.SyncSend(ptyp, testKey(t), "a:1"); !errors.Is(err, ErrBinaryOverDelimiter) {
+		t.Fatalf("expect ErrBinaryOverDelimiter, got %v", err)
+	}
+
+	if err := lr.Listen(ptyp, testKey(t)); !errors.Is(err, ErrBinaryOverDelimiter) {
+		t.Fatalf("expect ErrBinaryOverDelimiter, got %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+// The framing with a length header of configurable width and endianness,
+// DefaultEnDecPacket is the 4 bytes big endian case of it.
+package listenrain
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+type FixedHeaderEnDecPacket struct {
+	PacketOptions
+	// 1, 2, 4 or 8, 0 means 4
+	HeaderSize int
+	// nil means big endian
+	ByteOrder binary.ByteOrder
+	// The length in the header counts the header itself
+	LengthIncludesHeader bool
+}
+
+func (ed *FixedHeaderEnDecPacket) headerSize() (int, error) {
+	if ed.HeaderSize == 0 {
+		return DEFAULT_PACKET_HEAD_BYTE_SIZE, nil
+	}
+	return ed.HeaderSize, checkLengthFieldSize(ed.HeaderSize)
+}
+
+func (ed *FixedHeaderEnDecPacket) byteOrder() binary.ByteOrder {
+	if ed.ByteOrder == nil {
+		return binary.BigEndian
+	}
+	return ed.ByteOrder
+}
+
+func (ed *FixedHeaderEnDecPacket) putHeader(head []byte, size int) error {
+	if err := ed.checkSize(uint64(size)); err != nil {
+		return err
+	}
+
+	length := uint64(size)
+	if ed.LengthIncludesHeader {
+		length += uint64(len(head))
+	}
+
+	if len(head) < 8 && length >= 1<<(8*uint(len(head))) {
+		return &PacketSizeError{Size: length, Max: 1<<(8*uint(len(head))) - 1}
+	}
+	return putUint(ed.byteOrder(), head, length)
+}
+
+func (ed *FixedHeaderEnDecPacket) CheckPacket(payload []byte) error {
+	var head [8]byte
+	hsize, err := ed.headerSize()
+	if err != nil {
+		return err
+	}
+	return ed.putHeader(head[:hsize], len(payload))
+}
+
+func (ed *FixedHeaderEnDecPacket) EncodePacket(w io.Writer, payload []byte) error {
+	var head [8]byte
+	hsize, err := ed.headerSize()
+	if err != nil {
+		return err
+	}
+
+	err = ed.putHeader(head[:hsize], len(payload))
+	if err != nil {
+		return err
+	}
+
+	err = writeFull(w, head[:hsize])
+	if err != nil {
+		return err
+	}
+	return writeFull(w, payload)
+}
+
+func (ed *FixedHeaderEnDecPacket) AppendPacket(bufs net.Buffers, payload []byte) (net.Buffers, error) {
+	hsize, err := ed.headerSize()
+	if err != nil {
+		return bufs, err
+	}
+
+	head := make([]byte, hsize)
+	err = ed.putHeader(head, len(payload))
+	if err != nil {
+		return bufs, err
+	}
+	return append(bufs, head, payload), nil
+}
+
+func (ed *FixedHeaderEnDecPacket) DecodePacket(r io.Reader) ([]byte, error) {
+	var head [8]byte
+	hsize, err := ed.headerSize()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.ReadFull(r, head[:hsize])
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := getUint(ed.byteOrder(), head[:hsize])
+	if err != nil {
+		return nil, err
+	}
+
+	if ed.LengthIncludesHeader {
+		if size < uint64(hsize) {
+			return nil, fmt.Errorf("%w, length:%d less than header:%d", ErrProtocolViolation, size, hsize)
+		}
+		size -= uint64(hsize)
+	}
+
+	if size == 0 {
+		return nil, nil
+	}
+	return ed.readBody(r, size)
+}
+
+func checkLengthFieldSize(size int) error {
+	switch size {
+	case 1, 2, 4, 8:
+		return nil
+	}
+	return fmt.Errorf("not supported length field size:%d", size)
+}
+
+func putUint(order binary.ByteOrder, b []byte, v uint64) error {
+	switch len(b) {
+	case 1:
+		b[0] = byte(v)
+	case 2:
+		order.PutUint16(b, uint16(v))
+	case 4:
+		order.PutUint32(b, uint32(v))
+	case 8:
+		order.PutUint64(b, v)
+	default:
+		return fmt.Errorf("not supported length field size:%d", len(b))
+	}
+	return nil
+}
+
+func getUint(order binary.ByteOrder, b []byte) (uint64, error) {
+	switch len(b) {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(order.Uint16(b)), nil
+	case 4:
+		return uint64(order.Uint32(b)), nil
+	case 8:
+		return order.Uint64(b), nil
+	}
+	return 0, fmt.Errorf("not supported length field size:%d", len(b))
+}
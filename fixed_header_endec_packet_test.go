@@ -0,0 +1,48 @@
+package listenrain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestFixedHeaderEnDecPacketRoundTrip(t *testing.T) {
+	edp := &FixedHeaderEnDecPacket{HeaderSize: 2, ByteOrder: binary.LittleEndian, LengthIncludesHeader: true}
+	var buf bytes.Buffer
+	if err := edp.EncodePacket(&buf, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf.Bytes()[:2], []byte{7, 0}) {
+		t.Fatalf("unexpected header %v", buf.Bytes()[:2])
+	}
+
+	p, err := edp.DecodePacket(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(p) != "hello" {
+		t.Fatalf("unexpected payload %q", p)
+	}
+}
+
+func TestFixedHeaderEnDecPacketOverflow(t *testing.T) {
+	edp := &FixedHeaderEnDecPacket{HeaderSize: 1}
+	if err := edp.CheckPacket(make([]byte, 255)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the length doesn't fit in the header
+	if err := edp.CheckPacket(make([]byte, 256)); !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatalf("expect ErrPacketTooLarge, got %v", err)
+	}
+}
+
+func TestFixedHeaderEnDecPacketViolation(t *testing.T) {
+	edp := &FixedHeaderEnDecPacket{HeaderSize: 1, LengthIncludesHeader: true}
+	if _, err := edp.DecodePacket(bytes.NewReader([]byte{0})); !errors.Is(err, ErrProtocolViolation) {
+		t.Fatalf("expect ErrProtocolViolation, got %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+// The heartbeats of the connections. The client of a Multiplex protocol
+// type pings the server every HeartbeatInterval, and declares the transport
+// broken after HeartbeatMisses intervals without any packet from the server,
+// it is recovered as on a read error. The server answers the pings and
+// closes the connections idle for IdleTimeout.
+package listenrain
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_HEARTBEAT_MISSES = 3
+	// the shortest HeartbeatInterval, and half of the shortest IdleTimeout
+	MIN_HEARTBEAT_PERIOD = time.Millisecond
+)
+
+var (
+	ErrHeartbeatTimeout = errors.New("heartbeat timeout")
+	ErrIdleTimeout      = errors.New("connection idle timeout")
+	ErrInvalidHeartbeat = errors.New("invalid heartbeat setting")
+)
+
+// the tickers of the heartbeat and of the idle check can't tick faster
+// than MIN_HEARTBEAT_PERIOD, the idle check ticks every IdleTimeout/2,
+// only the envelope of Multiplex carries the pings
+func (pt *protocolType) checkHeartbeat() error {
+	if pt.HeartbeatInterval > 0 && !pt.Multiplex {
+		return fmt.Errorf("%w, HeartbeatInterval, %s", ErrInvalidHeartbeat, ErrMultiplexRequired)
+	}
+
+	if pt.HeartbeatInterval > 0 && pt.HeartbeatInterval < MIN_HEARTBEAT_PERIOD {
+		return fmt.Errorf("%w, HeartbeatInterval %s is less than %s", ErrInvalidHeartbeat, pt.HeartbeatInterval, MIN_HEARTBEAT_PERIOD)
+	}
+
+	if pt.IdleTimeout > 0 && pt.IdleTimeout < 2*MIN_HEARTBEAT_PERIOD {
+		return fmt.Errorf("%w, IdleTimeout %s is less than %s", ErrInvalidHeartbeat, pt.IdleTimeout, 2*MIN_HEARTBEAT_PERIOD)
+	}
+	return nil
+}
+
+func (pt *protocolType) heartbeatMisses() int32 {
+	if pt.HeartbeatMisses <= 0 {
+		return DEFAULT_HEARTBEAT_MISSES
+	}
+	return int32(pt.HeartbeatMisses)
+}
+
+func isFrameKind(payload []byte, kind FrameKind) bool {
+	return len(payload) >= FRAME_HEAD_BYTE_SIZE && FrameKind(payload[0]) == kind
+}
+
+// ping the server by ch until stop is closed, ch is closed after too many
+// missed heartbeats, then the transport is recovered as on a read error
+func (t *Transport) heartbeat(ch Channel, stop <-chan struct{}) {
+	var (
+		misses = t.pt.heartbeatMisses()
+		tc     = time.NewTicker(t.pt.HeartbeatInterval)
+	)
+	defer tc.Stop()
+
+	ping, err := encodeFrame(&frameHeader{kind: FRAME_PING}, nil)
+	if err != nil {
+		log.Printf("client transport encode ping, %s", err)
+		return
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tc.C:
+		}
+
+		// the ping which doesn't fit in the full queue is dropped, the
+		// interval is counted all the same, the writer blocked on the dead
+		// peer fills the queue
+		t.q.TryPush(ping)
+
+		// any packet received resets it
+		if atomic.AddInt32(&t.missed, 1) > misses {
+			log.Printf("client transport to %s missed %d heartbeats", ch.PeerInfo(), misses)
+			ch.Close()
+			// wake up the sender blocked on the empty queue, it fails on the closed channel
+			t.q.TryPush(ping)
+			return
+		}
+	}
+}
+
+// whether the channel is closed by heartbeat
+func (t *Transport) heartbeatTimeout() bool {
+	return t.pt.Multiplex && t.pt.HeartbeatInterval > 0 &&
+		atomic.LoadInt32(&t.missed) > t.pt.heartbeatMisses()
+}
+
+// close the connection which receives nothing for IdleTimeout
+func (t *serverTransport) idleCheck() {
+	timeout := t.pt.IdleTimeout
+	tc := time.NewTicker(timeout / 2)
+	defer tc.Stop()
+
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case now := <-tc.C:
+			last := time.Unix(0, atomic.LoadInt64(&t.lastRead))
+			if now.Sub(last) > timeout {
+				log.Printf("server transport from %s idle for %s", t.ch.PeerInfo(), now.Sub(last))
+				t.shutdown(ErrIdleTimeout)
+				return
+			}
+		}
+	}
+}
+
+// answer the ping by the receive loop, so a busy executor doesn't delay it
+func (t *serverTransport) pong(ping []byte) {
+	h, _, err := decodeFrame(ping)
+	if err != nil {
+		return
+	}
+
+	pong, err := encodeFrame(&frameHeader{kind: FRAME_PONG, reqId: h.reqId}, nil)
+	if err != nil {
+		return
+	}
+	t.q.TryPush(pong)
+}
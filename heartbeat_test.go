@@ -0,0 +1,141 @@
+package listenrain
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckHeartbeat(t *testing.T) {
+	cases := []struct {
+		interval, idle time.Duration
+		multiplex      bool
+		valid          bool
+	}{
+		{0, 0, false, true},
+		{MIN_HEARTBEAT_PERIOD, 2 * MIN_HEARTBEAT_PERIOD, true, true},
+		{time.Nanosecond, 0, true, false},
+		{0, time.Nanosecond, false, false},
+		{0, MIN_HEARTBEAT_PERIOD, false, false},
+		// only the envelope of Multiplex carries the pings
+		{MIN_HEARTBEAT_PERIOD, 0, false, false},
+	}
+	for _, c := range cases {
+		pt := &protocolType{HeartbeatInterval: c.interval, IdleTimeout: c.idle, Multiplex: c.multiplex}
+		err := pt.checkHeartbeat()
+		if c.valid != (err == nil) {
+			t.Fatalf("interval:%s idle:%s multiplex:%v, unexpected %v", c.interval, c.idle, c.multiplex, err)
+		}
+
+		if err != nil && !errors.Is(err, ErrInvalidHeartbeat) {
+			t.Fatalf("expect ErrInvalidHeartbeat, got %v", err)
+		}
+	}
+}
+
+// Listen fails instead of the idle check panicking
+func TestListenRejectsInvalidIdleTimeout(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	ptyp := lr.RegisterServerProtocol(testCodec{}, &DefaultEnDecPacket{}, testTimeout,
+		NewTcpServerChannleGenerator, DefaultQueueGenerator, DefaultExecutorGenerator, testEchoRouter, "test")
+	lr.ProtocolType(ptyp).IdleTimeout = time.Nanosecond
+
+	if err := lr.Listen(ptyp, testKey(t)); !errors.Is(err, ErrInvalidHeartbeat) {
+		t.Fatalf("expect ErrInvalidHeartbeat, got %v", err)
+	}
+}
+
+// the writer blocked on the dead peer fills the queue, the intervals whose
+// pings don't fit in it are missed all the same
+func TestHeartbeatFullQueue(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	q := NewBoundedQueue(0, 1, OVERFLOW_REJECT)
+	q.Push([]byte("pending"))
+	tr := &Transport{
+		pt: &protocolType{Multiplex: true, HeartbeatInterval: 5 * time.Millisecond, HeartbeatMisses: 1},
+		q:  q,
+	}
+
+	done := make(chan struct{})
+	stop := make(chan struct{})
+	go func() {
+		tr.heartbeat(&TcpChannel{local}, stop)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(testTimeout()):
+		close(stop)
+		t.Fatal("the missed heartbeats don't close the channel")
+	}
+
+	if !tr.heartbeatTimeout() {
+		t.Fatalf("expect the heartbeat timeout, missed %d", atomic.LoadInt32(&tr.missed))
+	}
+
+	if _, err := remote.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expect the channel closed, got %v", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	key := testServer(t, testEchoRouter, func(pt *protocolType) {
+		pt.IdleTimeout = 50 * time.Millisecond
+	})
+
+	c, err := net.Dial("tcp", key.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(testTimeout()))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expect the idle connection closed, got %v", err)
+	}
+}
+
+// the server answers the pings, which keep the idle connection open
+func TestPingKeepsConnection(t *testing.T) {
+	key := testServer(t, testEchoRouter, func(pt *protocolType) {
+		pt.Multiplex = true
+		pt.IdleTimeout = 100 * time.Millisecond
+	})
+
+	c, err := net.Dial("tcp", key.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	edp := &DefaultEnDecPacket{}
+	ping, err := encodeFrame(&frameHeader{kind: FRAME_PING, reqId: 7}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// idle for twice IdleTimeout but for the pings
+	for i := 0; i < 10; i++ {
+		if err := edp.EncodePacket(c, ping); err != nil {
+			t.Fatal(err)
+		}
+
+		c.SetReadDeadline(time.Now().Add(testTimeout()))
+		pong, err := edp.DecodePacket(c)
+		if err != nil {
+			t.Fatalf("ping %d, %v", i, err)
+		}
+
+		h, _, err := decodeFrame(pong)
+		if err != nil || h.kind != FRAME_PONG || h.reqId != 7 {
+			t.Fatalf("ping %d, expect the pong, got %v %v", i, h, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
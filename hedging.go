@@ -0,0 +1,191 @@
+package listenrain
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// SyncSend sends a duplicate of the request to the next backup key when
+// no response arrives within delay (e.g. the p95 latency) or the request
+// fails on its transport, the first response wins and the other requests
+// are cancelled. The *RemoteError responded is returned, the server did
+// answer. Only for the idempotent requests. Without backups, the other
+// endpoints of a HATCPTransportKey than the one in use are the backups.
+func WithHedging(delay time.Duration, backups ...TransportKey) SendOption {
+	return func(so *sendOptions) {
+		so.hedgeDelay = delay
+		so.hedgeKeys = backups
+	}
+}
+
+// inUse is the channel the transport of key is connected by, the active
+// endpoint is assumed when it's nil or unknown. The backup of the same
+// Key as key is skipped, the transport pool would give the transport of
+// key again.
+func hedgeBackups(key TransportKey, backups []TransportKey, inUse Channel) []TransportKey {
+	if len(backups) > 0 {
+		distinct := make([]TransportKey, 0, len(backups))
+		for _, backup := range backups {
+			if backup.Key() != key.Key() {
+				distinct = append(distinct, backup)
+			}
+		}
+		return distinct
+	}
+
+	ha, ok := key.(*HATCPTransportKey)
+	if !ok || len(ha.endpoints) < 2 {
+		return nil
+	}
+
+	used := ha.connectedEndpoint(inUse)
+	if used < 0 {
+		used = 0
+	}
+
+	backups = make([]TransportKey, 0, len(ha.endpoints)-1)
+	for i, ep := range ha.endpoints {
+		// after the failover, the transport of key is connected to a standby
+		// endpoint, and the active one shares its Key
+		if i == used || ep.Key() == key.Key() {
+			continue
+		}
+
+		backup := &TCPTransportKey{}
+		backup.Ip, backup.Port = ep.Ip, ep.Port
+		backups = append(backups, backup)
+	}
+	return backups
+}
+
+// index of the endpoint ch is connected to, -1 if unknown
+func (k *HATCPTransportKey) connectedEndpoint(ch Channel) int {
+	if nc, ok := ch.(NetConnChannel); ok {
+		return k.endpointOf(nc.NetConn().RemoteAddr())
+	}
+	return -1
+}
+
+// index of the endpoint addr is connected to, -1 if none
+func (k *HATCPTransportKey) endpointOf(addr net.Addr) int {
+	if addr == nil {
+		return -1
+	}
+
+	for i := range k.endpoints {
+		epAddr, err := net.ResolveTCPAddr("tcp", (&k.endpoints[i]).Key())
+		if err == nil && epAddr.String() == addr.String() {
+			return i
+		}
+	}
+	return -1
+}
+
+type hedgeResult struct {
+	v   interface{}
+	err error
+}
+
+// The state machine of one of the hedged requests
+type hedgeStatMachine struct {
+	c chan<- hedgeResult
+}
+
+func (hsm *hedgeStatMachine) keepMessage() {}
+
+func (hsm *hedgeStatMachine) Process(msgId string, v interface{}) {
+	hsm.c <- hedgeResult{v: v}
+}
+
+func (hsm *hedgeStatMachine) ProcessError(msgId string, err *RemoteError) {
+	hsm.c <- hedgeResult{err: err}
+}
+
+func (hsm *hedgeStatMachine) Timeout(msgId string) {
+	hsm.c <- hedgeResult{err: SSM_TIMEOUT_ERROR}
+}
+
+type hedgeAttempt struct {
+	t   *Transport
+	key timerKey
+}
+
+func (lr *ListenRain) hedgedSyncSend(protoTyps *protocolType, key TransportKey, msg interface{}, so *sendOptions) (interface{}, error) {
+	var (
+		keys     = append([]TransportKey{key}, hedgeBackups(key, so.hedgeKeys, nil)...)
+		next     int
+		results  = make(chan hedgeResult, len(keys))
+		attempts = make([]hedgeAttempt, 0, len(keys))
+		firstErr error
+		// the *RemoteError responded, no more hedging
+		answered error
+	)
+
+	// send to the next key, return false if there is none
+	hedge := func() bool {
+		for next < len(keys) {
+			k := keys[next]
+			next++
+
+			transport, adm, err := lr.admit(protoTyps, k)
+			if err == nil {
+				var tk timerKey
+				tk, err = transport.send(&hedgeStatMachine{c: results}, k, msg, so, adm)
+				if err == nil {
+					attempts = append(attempts, hedgeAttempt{t: transport, key: tk})
+					return true
+				}
+			}
+
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		return false
+	}
+
+	if hedge() && next == 1 {
+		// skip the endpoint the request went to
+		keys = append(keys[:1], hedgeBackups(key, so.hedgeKeys, attempts[0].t.ch)...)
+	}
+
+	tm := time.NewTimer(so.hedgeDelay)
+	defer tm.Stop()
+	for pending := len(attempts); pending > 0; {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// the losers are discarded
+				for _, a := range attempts {
+					a.t.cancel(a.key)
+				}
+				return r.v, nil
+			}
+
+			var rerr *RemoteError
+			if errors.As(r.err, &rerr) && answered == nil {
+				answered = r.err
+			}
+
+			if firstErr == nil {
+				firstErr = r.err
+			}
+
+			// don't wait for the delay after the transport failure, nobody else is pending
+			if pending == 0 && answered == nil && hedge() {
+				pending++
+			}
+		case <-tm.C:
+			if answered == nil && hedge() {
+				pending++
+				tm.Reset(so.hedgeDelay)
+			}
+		}
+	}
+	if answered != nil {
+		return nil, answered
+	}
+	return nil, firstErr
+}
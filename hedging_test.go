@@ -0,0 +1,223 @@
+package listenrain
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// the channel connected to addr
+type testAddrChannel struct {
+	Channel
+	addr net.Addr
+}
+
+type testAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c testAddrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (ch testAddrChannel) NetConn() net.Conn {
+	return testAddrConn{addr: ch.addr}
+}
+
+func testHAKey() *HATCPTransportKey {
+	key := &HATCPTransportKey{}
+	key.SetActive("127.0.0.1", 7001)
+	key.SetStandBy("127.0.0.1", 7002)
+	key.SetStandBy("127.0.0.1", 7003)
+	return key
+}
+
+func testKeysOf(keys []TransportKey) []string {
+	s := make([]string, len(keys))
+	for i := range keys {
+		s[i] = keys[i].Key()
+	}
+	return s
+}
+
+func TestHedgeBackups(t *testing.T) {
+	explicit := []TransportKey{testKey(t)}
+	if backups := hedgeBackups(testHAKey(), explicit, nil); len(backups) != 1 || backups[0] != explicit[0] {
+		t.Fatalf("expect the backups given, got %v", testKeysOf(backups))
+	}
+
+	// the transport of the primary key is not a backup
+	primary := testKey(t)
+	explicit = []TransportKey{primary, explicit[0]}
+	if backups := hedgeBackups(primary, explicit, nil); len(backups) != 1 || backups[0] != explicit[1] {
+		t.Fatalf("expect the other backup, got %v", testKeysOf(backups))
+	}
+
+	if backups := hedgeBackups(testKey(t), nil, nil); len(backups) != 0 {
+		t.Fatalf("expect no backups, got %v", testKeysOf(backups))
+	}
+
+	cases := []struct {
+		inUse  Channel
+		expect []string
+	}{
+		{nil, []string{"127.0.0.1:7002", "127.0.0.1:7003"}},
+		// after the failover to the first standby endpoint, the active one
+		// shares the key of the transport in use
+		{testAddrChannel{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7002}},
+			[]string{"127.0.0.1:7003"}},
+		// unknown endpoint, the active one is assumed
+		{testAddrChannel{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7009}},
+			[]string{"127.0.0.1:7002", "127.0.0.1:7003"}},
+	}
+	for _, c := range cases {
+		backups := testKeysOf(hedgeBackups(testHAKey(), nil, c.inUse))
+		if len(backups) != len(c.expect) {
+			t.Fatalf("expect %v, got %v", c.expect, backups)
+		}
+		for i := range c.expect {
+			if backups[i] != c.expect[i] {
+				t.Fatalf("expect %v, got %v", c.expect, backups)
+			}
+		}
+	}
+}
+
+func TestHedgingSlowPrimary(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	mux := func(pt *protocolType) { pt.Multiplex = true }
+	slow := testServer(t, func(response ServerResponse, msgId string, cmd int, message interface{}) error {
+		time.Sleep(500 * time.Millisecond)
+		return response.Response("slow:1")
+	}, mux)
+	backup := testServer(t, testEchoRouter, mux)
+	ptyp := testClient(lr, mux)
+
+	start := time.Now()
+	v, err := lr.SyncSend(ptyp, slow, "a:1", WithHedging(20*time.Millisecond, backup))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != "a:1" {
+		t.Fatalf("expect the response of the backup, got %v", v)
+	}
+
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Fatalf("the hedged request waited for the slow primary, %s", elapsed)
+	}
+}
+
+// the server answered, the request is not hedged
+func TestHedgingRemoteError(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	mux := func(pt *protocolType) { pt.Multiplex = true }
+	primary := testServer(t, func(response ServerResponse, msgId string, cmd int, message interface{}) error {
+		return ResponseError(response, ERROR_CODE_BAD_REQUEST, "bad")
+	}, mux)
+	var hedged int32
+	backup := testServer(t, func(response ServerResponse, msgId string, cmd int, message interface{}) error {
+		atomic.AddInt32(&hedged, 1)
+		return response.Response(message)
+	}, mux)
+	ptyp := testClient(lr, mux)
+
+	_, err := lr.SyncSend(ptyp, primary, "a:1", WithHedging(time.Second, backup))
+	var rerr *RemoteError
+	if !errors.As(err, &rerr) || rerr.Code != ERROR_CODE_BAD_REQUEST {
+		t.Fatalf("expect the *RemoteError of the primary, got %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&hedged); n != 0 {
+		t.Fatalf("expect no hedged request, got %d", n)
+	}
+}
+
+// the request failing on its transport is hedged at once
+func TestHedgingTransportFailure(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	mux := func(pt *protocolType) { pt.Multiplex = true }
+	silent := testServer(t, testSilentRouter, mux)
+	backup := testServer(t, testEchoRouter, mux)
+	ptyp := testClient(lr, mux)
+
+	v, err := lr.SyncSend(ptyp, silent, "a:1", WithTimeout(50*time.Millisecond), WithHedging(time.Minute, backup))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != "a:1" {
+		t.Fatalf("expect the response of the backup, got %v", v)
+	}
+}
+
+// the active endpoint closes the first connection and is gone, the
+// transport fails over to the first standby endpoint
+func testFailedOverHAKey(t *testing.T, standby ...*TCPTransportKey) *HATCPTransportKey {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		defer ln.Close()
+		if c, err := ln.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+
+	key := &HATCPTransportKey{}
+	key.SetActive("127.0.0.1", ln.Addr().(*net.TCPAddr).Port)
+	for _, k := range standby {
+		key.SetStandBy(k.Ip, k.Port)
+	}
+	return key
+}
+
+// after the failover, the duplicate goes to another endpoint than the one in use
+func TestHedgingAfterFailover(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	mux := func(pt *protocolType) { pt.Multiplex = true }
+	var slowHedged int32
+	slow := testServer(t, func(response ServerResponse, msgId string, cmd int, message interface{}) error {
+		if message == "h:1" {
+			atomic.AddInt32(&slowHedged, 1)
+			time.Sleep(300 * time.Millisecond)
+		}
+		return response.Response(message)
+	}, mux)
+	backup := testServer(t, func(response ServerResponse, msgId string, cmd int, message interface{}) error {
+		return response.Response("backup:1")
+	}, mux)
+	key := testFailedOverHAKey(t, slow, backup)
+	ptyp := testClient(lr, mux)
+
+	// the request lost with the closed connection is sent again
+	var err error
+	for i := 0; i < 10; i++ {
+		if _, err = lr.SyncSend(ptyp, key, "w:1", WithTimeout(200*time.Millisecond)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("the transport doesn't fail over, %v", err)
+	}
+
+	v, err := lr.SyncSend(ptyp, key, "h:1", WithHedging(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != "backup:1" {
+		t.Fatalf("expect the response of the other standby endpoint, got %v", v)
+	}
+
+	if n := atomic.LoadInt32(&slowHedged); n != 1 {
+		t.Fatalf("expect 1 request to the endpoint in use, got %d", n)
+	}
+}
@@ -0,0 +1,52 @@
+package listenrain
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrTooManyInFlight = errors.New("too many in-flight requests")
+)
+
+// The slots of the in-flight requests, taken by Send and given back when
+// the response arrives or the request times out
+type inflightSemaphore struct {
+	c chan struct{}
+}
+
+func newInflightSemaphore(n int) *inflightSemaphore {
+	return &inflightSemaphore{
+		c: make(chan struct{}, n),
+	}
+}
+
+// wait for a slot until ctx is done, unless failFast
+func (s *inflightSemaphore) acquire(ctx context.Context, failFast bool) error {
+	select {
+	case s.c <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if failFast {
+		return ErrTooManyInFlight
+	}
+
+	select {
+	case s.c <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *inflightSemaphore) release() {
+	<-s.c
+}
+
+// the semaphore of the TransportKey shared by the transports of the protocol type
+func (pt *protocolType) keySemaphore(key TransportKey) *inflightSemaphore {
+	v, _ := pt.keySems.LoadOrStore(key.Key(), newInflightSemaphore(pt.MaxInFlightPerKey))
+	return v.(*inflightSemaphore)
+}
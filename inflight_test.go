@@ -0,0 +1,163 @@
+package listenrain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// swallow the request, the client waits until it times out
+func testSilentRouter(response ServerResponse, msgId string, cmd int, message interface{}) error {
+	return nil
+}
+
+// StatMachinePool without TryPut, Put overwrites the reused msgId
+type testPlainStatMachinePool struct {
+	mtx sync.Mutex
+	c   map[string]StatMachine
+}
+
+func (p *testPlainStatMachinePool) Put(msgId string, sm StatMachine) {
+	p.mtx.Lock()
+	p.c[msgId] = sm
+	p.mtx.Unlock()
+}
+
+func (p *testPlainStatMachinePool) Pop(msgId string) StatMachine {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	sm := p.c[msgId]
+	delete(p.c, msgId)
+	return sm
+}
+
+func TestInflightSemaphore(t *testing.T) {
+	s := newInflightSemaphore(1)
+	if err := s.acquire(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.acquire(context.Background(), true); !errors.Is(err, ErrTooManyInFlight) {
+		t.Fatalf("expect ErrTooManyInFlight, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.acquire(ctx, false); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect to wait until the context is done, got %v", err)
+	}
+
+	s.release()
+	if err := s.acquire(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	key := testServer(t, testSilentRouter, nil)
+	ptyp := testClient(lr, func(pt *protocolType) {
+		pt.MaxInFlight = 1
+		pt.FailFastInFlight = true
+	})
+
+	sm := newTestStatMachine()
+	if err := lr.Send(ptyp, sm, key, "a:1", WithTimeout(50*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lr.Send(ptyp, sm, key, "b:1"); !errors.Is(err, ErrTooManyInFlight) {
+		t.Fatalf("expect ErrTooManyInFlight, got %v", err)
+	}
+
+	select {
+	case <-sm.timeouts:
+	case <-time.After(testTimeout()):
+		t.Fatal("the request doesn't time out")
+	}
+
+	// the timeout gives the slot back
+	if err := lr.Send(ptyp, sm, key, "c:1", WithTimeout(50*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testPlainClient(lr *ListenRain, maxInFlight int) ProtocolType {
+	return testClient(lr, func(pt *protocolType) {
+		pt.MaxInFlight = maxInFlight
+		pt.FailFastInFlight = true
+		pt.StatMachinePoolGenerator = func(TransportKey) (StatMachinePool, error) {
+			return &testPlainStatMachinePool{c: make(map[string]StatMachine)}, nil
+		}
+	})
+}
+
+// the request displaced by the reused msgId times out and gives its slot back
+func TestDuplicateMsgIdReleasesInFlight(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	key := testServer(t, testSilentRouter, nil)
+	ptyp := testPlainClient(lr, 1)
+
+	sm := newTestStatMachine()
+	for i := 0; i < 3; i++ {
+		// ErrTooManyInFlight if the displaced request holds the slot
+		if err := lr.Send(ptyp, sm, key, "a:1", WithTimeout(time.Hour)); err != nil {
+			t.Fatalf("send %d, %v", i, err)
+		}
+	}
+
+	// the displaced ones time out at once, the last one is still in flight
+	for i := 0; i < 2; i++ {
+		select {
+		case <-sm.timeouts:
+		case <-time.After(testTimeout()):
+			t.Fatalf("the displaced request %d doesn't time out", i)
+		}
+	}
+
+	select {
+	case <-sm.timeouts:
+		t.Fatal("the last request timed out")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// every one of the concurrent requests of the same msgId is answered
+// by a response or a timeout, none of them leaks its slot
+func TestConcurrentDuplicateMsgId(t *testing.T) {
+	const n = 32
+	lr := NewListenRain(NewDefaultTransportPool())
+	key := testServer(t, testSilentRouter, nil)
+	ptyp := testPlainClient(lr, n)
+
+	sm := newTestStatMachine()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := lr.Send(ptyp, sm, key, "a:1", WithTimeout(time.Hour)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < n-1; i++ {
+		select {
+		case <-sm.timeouts:
+		case <-time.After(testTimeout()):
+			t.Fatalf("%d of %d displaced requests time out", i, n-1)
+		}
+	}
+
+	// only the one in flight holds a slot
+	for i := 0; i < n-1; i++ {
+		if err := lr.Send(ptyp, sm, key, fmt.Sprintf("b%d:1", i), WithTimeout(time.Hour)); err != nil {
+			t.Fatalf("send %d, %v", i, err)
+		}
+	}
+}
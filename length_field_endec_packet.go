@@ -0,0 +1,168 @@
+// The framing of legacy binary protocols, whose length field is
+// somewhere in the header of the frame.
+//
+// format:
+//
+//	+-------------------+--------------+---------------------------------+
+//	|    header bytes   | length field |       rest of the frame         |
+//	+-------------------+--------------+---------------------------------+
+//	| LengthFieldOffset | 1/2/4/8 byte | length + LengthAdjustment bytes |
+//	+-------------------+--------------+---------------------------------+
+package listenrain
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+)
+
+// DecodePacket returns the whole frame without the first InitialBytesToStrip
+// bytes, EncodePacket expects the payload to be the whole frame whatever
+// InitialBytesToStrip is, and fills in its length field.
+type LengthFieldEnDecPacket struct {
+	PacketOptions
+	LengthFieldOffset int
+	// 1, 2, 4 or 8, 0 means 4
+	LengthFieldSize int
+	// nil means big endian
+	ByteOrder binary.ByteOrder
+	// added to the length field to get the size of the rest of the frame,
+	// e.g. -N when the length counts the N bytes of the whole header
+	LengthAdjustment    int
+	InitialBytesToStrip int
+}
+
+func (ed *LengthFieldEnDecPacket) fieldSize() (int, error) {
+	if ed.LengthFieldSize == 0 {
+		return DEFAULT_PACKET_HEAD_BYTE_SIZE, nil
+	}
+	return ed.LengthFieldSize, checkLengthFieldSize(ed.LengthFieldSize)
+}
+
+func (ed *LengthFieldEnDecPacket) byteOrder() binary.ByteOrder {
+	if ed.ByteOrder == nil {
+		return binary.BigEndian
+	}
+	return ed.ByteOrder
+}
+
+// return the header with the length field filled in
+func (ed *LengthFieldEnDecPacket) header(payload []byte) ([]byte, error) {
+	fsize, err := ed.fieldSize()
+	if err != nil {
+		return nil, err
+	}
+
+	hlen := ed.LengthFieldOffset + fsize
+	if len(payload) < hlen {
+		return nil, fmt.Errorf("%w, frame size:%d is less than the header:%d", ErrInvalidPayload, len(payload), hlen)
+	}
+
+	if err := ed.checkSize(uint64(len(payload))); err != nil {
+		return nil, err
+	}
+
+	length := len(payload) - hlen - ed.LengthAdjustment
+	if length < 0 {
+		return nil, fmt.Errorf("%w, frame size:%d is less than the length adjustment:%d", ErrInvalidPayload, len(payload), ed.LengthAdjustment)
+	}
+
+	head := make([]byte, hlen)
+	copy(head, payload[:hlen])
+	err = putUint(ed.byteOrder(), head[ed.LengthFieldOffset:], uint64(length))
+	if err != nil {
+		return nil, err
+	}
+	return head, nil
+}
+
+func (ed *LengthFieldEnDecPacket) CheckPacket(payload []byte) error {
+	_, err := ed.header(payload)
+	return err
+}
+
+func (ed *LengthFieldEnDecPacket) EncodePacket(w io.Writer, payload []byte) error {
+	head, err := ed.header(payload)
+	if err != nil {
+		return err
+	}
+
+	err = writeFull(w, head)
+	if err != nil {
+		return err
+	}
+	return writeFull(w, payload[len(head):])
+}
+
+func (ed *LengthFieldEnDecPacket) AppendPacket(bufs net.Buffers, payload []byte) (net.Buffers, error) {
+	head, err := ed.header(payload)
+	if err != nil {
+		return bufs, err
+	}
+	return append(bufs, head, payload[len(head):]), nil
+}
+
+func (ed *LengthFieldEnDecPacket) DecodePacket(r io.Reader) ([]byte, error) {
+	fsize, err := ed.fieldSize()
+	if err != nil {
+		return nil, err
+	}
+
+	hlen := ed.LengthFieldOffset + fsize
+	head := make([]byte, hlen)
+	_, err = io.ReadFull(r, head)
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := getUint(ed.byteOrder(), head[ed.LengthFieldOffset:])
+	if err != nil {
+		return nil, err
+	}
+
+	rest := int64(length) + int64(ed.LengthAdjustment)
+	if length > 1<<62 || rest < 0 {
+		return nil, fmt.Errorf("%w, length field:%d, adjustment:%d", ErrProtocolViolation, length, ed.LengthAdjustment)
+	}
+
+	total := int64(hlen) + rest
+	strip := int64(ed.InitialBytesToStrip)
+	if strip > total {
+		return nil, fmt.Errorf("%w, frame size:%d is less than the bytes to strip:%d", ErrProtocolViolation, total, strip)
+	}
+
+	if err := ed.checkSize(uint64(total - strip)); err != nil {
+		return nil, err
+	}
+
+	if total == strip {
+		_, err = io.CopyN(ioutil.Discard, r, rest)
+		return nil, err
+	}
+
+	buf, err := ed.allocate(uint32(total - strip))
+	if err != nil {
+		return nil, err
+	}
+
+	var n int
+	if strip < int64(hlen) {
+		n = copy(buf, head[strip:])
+	} else {
+		// the stripped bytes go beyond the header
+		_, err = io.CopyN(ioutil.Discard, r, strip-int64(hlen))
+		if err != nil {
+			ed.ReleasePacket(buf)
+			return nil, err
+		}
+	}
+
+	_, err = io.ReadFull(r, buf[n:])
+	if err != nil {
+		ed.ReleasePacket(buf)
+		return nil, err
+	}
+	return buf, nil
+}
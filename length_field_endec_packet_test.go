@@ -0,0 +1,68 @@
+package listenrain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestLengthFieldEnDecPacketRoundTrip(t *testing.T) {
+	// 2 bytes magic, 2 bytes little endian length counting the whole frame
+	edp := &LengthFieldEnDecPacket{
+		LengthFieldOffset: 2,
+		LengthFieldSize:   2,
+		ByteOrder:         binary.LittleEndian,
+		LengthAdjustment:  -4,
+	}
+	frame := []byte{0xca, 0xfe, 0, 0, 'h', 'i'}
+
+	var buf bytes.Buffer
+	if err := edp.EncodePacket(&buf, frame); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), []byte{0xca, 0xfe, 6, 0, 'h', 'i'}) {
+		t.Fatalf("unexpected frame %v", buf.Bytes())
+	}
+
+	edp.InitialBytesToStrip = 4
+	p, err := edp.DecodePacket(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(p) != "hi" {
+		t.Fatalf("expect the stripped frame, got %q", p)
+	}
+}
+
+// the header errors depend on the payload only, the sender drops it
+func TestLengthFieldEnDecPacketInvalidPayload(t *testing.T) {
+	cases := []struct {
+		edp   *LengthFieldEnDecPacket
+		frame []byte
+	}{
+		// shorter than the header
+		{&LengthFieldEnDecPacket{LengthFieldOffset: 2}, []byte{1, 2, 3}},
+		// shorter than the length adjustment
+		{&LengthFieldEnDecPacket{LengthAdjustment: 4}, []byte{0, 0, 0, 0, 1}},
+	}
+	for i, c := range cases {
+		if err := c.edp.CheckPacket(c.frame); !errors.Is(err, ErrInvalidPayload) {
+			t.Fatalf("case %d, expect ErrInvalidPayload, got %v", i, err)
+		}
+
+		_, err := c.edp.AppendPacket(nil, c.frame)
+		if err := dropUnencodable(err); err != nil {
+			t.Fatalf("case %d, expect the payload dropped, got %v", i, err)
+		}
+	}
+}
+
+func TestLengthFieldEnDecPacketViolation(t *testing.T) {
+	edp := &LengthFieldEnDecPacket{LengthFieldSize: 1, LengthAdjustment: -2}
+	if _, err := edp.DecodePacket(bytes.NewReader([]byte{1})); !errors.Is(err, ErrProtocolViolation) {
+		t.Fatalf("expect ErrProtocolViolation, got %v", err)
+	}
+}
@@ -1,15 +1,20 @@
 package listenrain
 
 import (
+	"context"
 	"errors"
 	"io"
 	"log"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	ErrInvalidTransport = errors.New("client transport is invalid")
+	ErrDuplicateMsgId   = errors.New("msgId is already in flight")
+	ErrQueueFull        = errors.New("queue is full")
 )
 
 type StatMachine interface {
@@ -22,6 +27,14 @@ type StatMachinePool interface {
 	Pop(msgId string) StatMachine
 }
 
+// StatMachinePool which is able to check the in-flight msgId atomically,
+// Transport.Send prefers it so that a reused msgId can't orphan the first state machine
+type UniqueStatMachinePool interface {
+	StatMachinePool
+	// put sm only when msgId is not in flight, otherwise return ErrDuplicateMsgId
+	TryPut(msgId string, sm StatMachine) error
+}
+
 type EnDecMessage interface {
 	EncodeMessage(message interface{}) (payload []byte, msgId string, err error)
 	DecodeMessage(payload []byte) (message interface{}, msgId string, err error)
@@ -29,22 +42,76 @@ type EnDecMessage interface {
 
 type Queue interface {
 	Push(payload []byte)
+	// push without blocking, return ErrQueueFull if there is no room
+	TryPush(payload []byte) error
+	// push until there is room or ctx is done
+	PushContext(ctx context.Context, payload []byte) error
 	Pop() (payload []byte)
 	PopNoBlocking() (payload []byte)
 	Drop()
 }
 
+// Queue which is able to queue the payload by priority, the
+// priority of the message is selected by WithPriority on Send
+type PriorityPusher interface {
+	PushPriority(ctx context.Context, payload []byte, priority int) error
+}
+
+// PriorityPusher which is able to push by priority without blocking, see WithNoWait
+type PriorityTryPusher interface {
+	// return ErrQueueFull if there is no room
+	TryPushPriority(payload []byte, priority int) error
+}
+
 type EnDecPacket interface {
 	EncodePacket(w io.Writer, payload []byte) error
 	DecodePacket(r io.Reader) ([]byte, error)
 }
 
+// EnDecPacket which is able to frame the payload into buffers, so that a batch
+// of payloads is flushed by one vectored write, see MaxBatchSize of the protocol.
+// A wrapper overriding EncodePacket should override AppendPacket as well.
+type BatchEnDecPacket interface {
+	EnDecPacket
+	AppendPacket(bufs net.Buffers, payload []byte) (net.Buffers, error)
+}
+
+// EnDecPacket which takes back the buffer allocated by DecodePacket, it is called
+// after StatMachine.Process or the ServerRouter returns, so neither the state
+// machine nor the router may reference the message afterwards. The buffer
+// processed by SyncStatMachine is never released, it's handed over to the caller.
+type PacketBufferReleaser interface {
+	ReleasePacket(buf []byte)
+}
+
+// EnDecPacket which checks the payload before it's queued, so that Send fails
+// at once with ErrPacketTooLarge or ErrInvalidPayload, instead of the payload
+// dropped by the sender and the request timing out
+type PacketChecker interface {
+	CheckPacket(payload []byte) error
+}
+
+// Queue which is able to drain a batch of payloads
+type BatchPopper interface {
+	// block until one payload at least, then pop up to len(buf) payloads,
+	// waiting at most latency for more, return 0 after Drop
+	PopBatch(buf [][]byte, latency time.Duration) int
+}
+
 type Channel interface {
 	io.ReadWriteCloser
 	IsActive() bool
 	PeerInfo() string
 }
 
+// Channel backed by a net.Conn, the batch of payloads is written to the
+// connection directly, so it goes out by one writev instead of one Write
+// per buffer
+type NetConnChannel interface {
+	Channel
+	NetConn() net.Conn
+}
+
 type ChannelGenerator interface {
 	Next() (Channel, error)
 	GC(Channel)
@@ -56,6 +123,11 @@ type ProtocolType int
 type ServerRouter func(response ServerResponse, msgId string, cmd int, message interface{}) error
 
 type protocolType struct {
+	// connections the server closed for protocol violations,
+	// first field for the 64-bit alignment of atomic
+	violations uint64
+	// requests the server rejected for the RateLimit
+	limited                  uint64
 	EdM                      EnDecMessage
 	EdP                      EnDecPacket
 	Timeout                  func() time.Duration
@@ -64,7 +136,52 @@ type protocolType struct {
 	ExecutorGenerator        func(TransportKey) (Executor, error)
 	StatMachinePoolGenerator func(TransportKey) (StatMachinePool, error)
 	ServerRouter             ServerRouter
-	Name                     string
+	// takes precedence over ServerRouter
+	ServerHandler ServerHandler
+	Name          string
+	// Limits of the requests of the server, nil means no limit
+	RateLimit *RateLimit
+	// Max in-flight requests of a client transport, <= 0 means unlimited
+	MaxInFlight int
+	// Max in-flight requests of a TransportKey, shared by the transports
+	// created for it, <= 0 means unlimited
+	MaxInFlightPerKey int
+	// Send returns ErrTooManyInFlight at once, instead of waiting for a
+	// slot until the context of WithContext is done
+	FailFastInFlight bool
+	// *inflightSemaphore of TransportKey.Key()
+	keySems sync.Map
+	// Fail fast the TransportKey failing too much, nil disables it
+	CircuitBreaker *CircuitBreakerConfig
+	// *CircuitBreaker of the endpoint key, see endpointKey
+	breakers sync.Map
+	// The client pings the server every interval, 0 disables it, it
+	// requires Multiplex
+	HeartbeatInterval time.Duration
+	// Intervals without any packet from the server before the client
+	// transport is recovered, 0 means DEFAULT_HEARTBEAT_MISSES
+	HeartbeatMisses int
+	// The server closes the connection receiving nothing for it, 0 disables it
+	IdleTimeout time.Duration
+	// The framework allocates the request ids and prefixes them on the wire,
+	// must be the same on both client and server side
+	Multiplex bool
+	// Max payloads flushed by one write, <= 1 disables batching, it takes effect
+	// when EdP implements BatchEnDecPacket and the Queue implements BatchPopper
+	MaxBatchSize int
+	// How long the sender waits for more payloads to fill the batch
+	BatchLatency time.Duration
+	// Size of the buffered reader of the channel, 0 means DEFAULT_READ_BUFFER_SIZE,
+	// < 0 disables the buffering
+	ReadBufferSize int
+}
+
+// reject the settings which never work
+func (pt *protocolType) validate() error {
+	if err := pt.checkHeartbeat(); err != nil {
+		return err
+	}
+	return checkBinaryFraming(pt.EdP, pt.Multiplex)
 }
 
 type TransportKey interface {
@@ -147,15 +264,53 @@ func (lr *ListenRain) RegisterServerProtocol(edm EnDecMessage, edp EnDecPacket,
 	return ptindex
 }
 
+// The server protocol whose handler receives the whole request, with the
+// context, peer info, transport key and metadata
+func (lr *ListenRain) RegisterServerProtocolV2(edm EnDecMessage, edp EnDecPacket,
+	timeout func() time.Duration,
+	channelGenerator func(TransportKey) (ChannelGenerator, error),
+	queueGenerator func(TransportKey) (Queue, error),
+	executor func(TransportKey) (Executor, error),
+	serverHandler ServerHandler,
+	name string) ProtocolType {
+
+	ptindex := lr.RegisterProtocol(edm, edp, timeout, channelGenerator,
+		queueGenerator, executor, nil)
+	pt := lr.ProtocolType(ptindex)
+	pt.ServerHandler = serverHandler
+	pt.Name = name
+	return ptindex
+}
+
 func (lr *ListenRain) ProtocolType(ptyp ProtocolType) *protocolType {
 	return lr.protoTyps[ptyp]
 }
 
-func (lr *ListenRain) Send(ptyp ProtocolType, sm StatMachine, key TransportKey, msg interface{}) error {
-	protoTyps := lr.protoTyps[ptyp]
+// Number of connections the server closed for protocol violations,
+// such as oversize packets, of the protocol type
+func (lr *ListenRain) ProtocolViolations(ptyp ProtocolType) uint64 {
+	return atomic.LoadUint64(&lr.protoTyps[ptyp].violations)
+}
+
+// Number of requests the server rejected for the RateLimit of the protocol type
+func (lr *ListenRain) RateLimited(ptyp ProtocolType) uint64 {
+	return atomic.LoadUint64(&lr.protoTyps[ptyp].limited)
+}
+
+// State of the circuit breaker of the endpoint TransportKey.Key(), CIRCUIT_CLOSED if the
+// protocol type has none
+func (lr *ListenRain) CircuitState(ptyp ProtocolType, key TransportKey) CircuitState {
+	cb := lr.protoTyps[ptyp].circuitBreaker(key.Key())
+	if cb == nil {
+		return CIRCUIT_CLOSED
+	}
+	return cb.State()
+}
+
+func (lr *ListenRain) transport(protoTyps *protocolType, key TransportKey) (*Transport, error) {
 	transport, err := lr.transportPool.Get(key, protoTyps)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if transport.state == TRANSPORT_DOWN {
@@ -165,36 +320,52 @@ func (lr *ListenRain) Send(ptyp ProtocolType, sm StatMachine, key TransportKey,
 			time.Sleep(10 * time.Second)
 			transport.Drop()
 		}()
-		return ErrInvalidTransport
+		return nil, ErrInvalidTransport
+	}
+	return transport, nil
+}
+
+// the transport of the key, unless the circuit breaker of the endpoint it
+// is connected to is open, and the admission of the request by the breaker,
+// the outcome of the request is reported by the transport
+func (lr *ListenRain) admit(protoTyps *protocolType, key TransportKey) (*Transport, admission, error) {
+	transport, err := lr.transport(protoTyps, key)
+	if err != nil {
+		return nil, admission{}, err
 	}
 
-	err = transport.Send(sm, key, msg)
+	adm, err := transport.admit()
 	if err != nil {
-		return err
+		return nil, admission{}, err
 	}
-	return nil
+	return transport, adm, nil
 }
 
-func (lr *ListenRain) SyncSend(ptyp ProtocolType, key TransportKey, msg interface{}) (interface{}, error) {
-	protoTyps := lr.protoTyps[ptyp]
-	transport, err := lr.transportPool.Get(key, protoTyps)
+func (lr *ListenRain) Send(ptyp ProtocolType, sm StatMachine, key TransportKey, msg interface{}, opts ...SendOption) error {
+	transport, adm, err := lr.admit(lr.protoTyps[ptyp], key)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if transport.state == TRANSPORT_DOWN {
-		lr.transportPool.Drop(key)
-		go func() {
-			// delay background gc
-			time.Sleep(10 * time.Second)
-			transport.Drop()
-		}()
-		return nil, ErrInvalidTransport
+	so := newSendOptions(opts)
+	_, err = transport.send(sm, key, msg, &so, adm)
+	return err
+}
+
+func (lr *ListenRain) SyncSend(ptyp ProtocolType, key TransportKey, msg interface{}, opts ...SendOption) (interface{}, error) {
+	so := newSendOptions(opts)
+	if so.hedgeDelay > 0 {
+		return lr.hedgedSyncSend(lr.protoTyps[ptyp], key, msg, &so)
+	}
+
+	transport, adm, err := lr.admit(lr.protoTyps[ptyp], key)
+	if err != nil {
+		return nil, err
 	}
 
 	ssm := lr.ssmPool.Get().(*SyncStatMachine)
 	ssm.Fire()
-	err = transport.Send(ssm, key, msg)
+	_, err = transport.send(ssm, key, msg, &so, adm)
 	if err != nil {
 		ssm.ShutDown()
 		lr.ssmPool.Put(ssm)
@@ -208,6 +379,11 @@ func (lr *ListenRain) SyncSend(ptyp ProtocolType, key TransportKey, msg interfac
 
 func (lr *ListenRain) Listen(ptyp ProtocolType, key TransportKey) error {
 	protoTyps := lr.protoTyps[ptyp]
+	err := protoTyps.validate()
+	if err != nil {
+		return err
+	}
+
 	cg, err := protoTyps.ChannelGenerator(key)
 	if err != nil {
 		return err
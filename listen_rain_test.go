@@ -0,0 +1,129 @@
+package listenrain
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The message is a string "msgId:body", the msgId is the part before the first colon
+type testCodec struct{}
+
+func (testCodec) EncodeMessage(message interface{}) ([]byte, string, error) {
+	s := message.(string)
+	return []byte(s), testMsgId(s), nil
+}
+
+func (testCodec) DecodeMessage(payload []byte) (interface{}, string, error) {
+	s := string(payload)
+	return s, testMsgId(s), nil
+}
+
+func testMsgId(s string) string {
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+func testTimeout() time.Duration {
+	return 2 * time.Second
+}
+
+// the key of a free local port
+func testKey(t *testing.T) *TCPTransportKey {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	key := &TCPTransportKey{}
+	key.Ip, key.Port = "127.0.0.1", ln.Addr().(*net.TCPAddr).Port
+	// cache the key before the concurrent Key calls
+	key.Key()
+	return key
+}
+
+// echo the message back
+func testEchoRouter(response ServerResponse, msgId string, cmd int, message interface{}) error {
+	return response.Response(message)
+}
+
+// start the server of router on a free port, setup adjusts the protocol type before Listen,
+// the server has its own ListenRain, Listen races with the registrations of the same one
+func testServer(t *testing.T, router ServerRouter, setup func(pt *protocolType)) *TCPTransportKey {
+	t.Helper()
+	lr := NewListenRain(NewDefaultTransportPool())
+	ptyp := lr.RegisterServerProtocol(testCodec{}, &DefaultEnDecPacket{}, testTimeout,
+		NewTcpServerChannleGenerator, DefaultQueueGenerator, DefaultExecutorGenerator, router, "test")
+	if setup != nil {
+		setup(lr.ProtocolType(ptyp))
+	}
+
+	key := testKey(t)
+	go lr.Listen(ptyp, key)
+	testWaitListening(t, key)
+	return key
+}
+
+func testWaitListening(t *testing.T, key *TCPTransportKey) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		c, err := net.Dial("tcp", key.Key())
+		if err == nil {
+			c.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server %s is not listening", key.Key())
+}
+
+func testClient(lr *ListenRain, setup func(pt *protocolType)) ProtocolType {
+	ptyp := lr.RegisterProtocol(testCodec{}, &DefaultEnDecPacket{}, testTimeout,
+		NewTcpClientChannelGeneratorV2, DefaultQueueGenerator, DefaultExecutorGenerator,
+		DefaultStatMachinePoolGenerator)
+	if setup != nil {
+		setup(lr.ProtocolType(ptyp))
+	}
+	return ptyp
+}
+
+// The StatMachine reporting the results on channels
+type testStatMachine struct {
+	results  chan interface{}
+	timeouts chan string
+}
+
+func newTestStatMachine() *testStatMachine {
+	return &testStatMachine{
+		results:  make(chan interface{}, 1024),
+		timeouts: make(chan string, 1024),
+	}
+}
+
+func (sm *testStatMachine) Process(msgId string, v interface{}) {
+	sm.results <- v
+}
+
+func (sm *testStatMachine) Timeout(msgId string) {
+	sm.timeouts <- msgId
+}
+
+func TestSyncSendEcho(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	key := testServer(t, testEchoRouter, nil)
+	ptyp := testClient(lr, nil)
+
+	v, err := lr.SyncSend(ptyp, key, "1:hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != "1:hello" {
+		t.Fatalf("unexpected response %v", v)
+	}
+}
@@ -0,0 +1,128 @@
+// The metadata carried by the multiplex envelope, such as trace ids, auth
+// tokens and tenant ids, without touching the message types.
+//
+// format, following the frame header when FRAME_FLAG_METADATA is set:
+//
+//	+----------+-----------+-----+-----------+-------+-----+
+//	|  count   | key size  | key | val size  |  val  | ... |
+//	+----------+-----------+-----+-----------+-------+-----+
+//	|  2 byte  |  2 byte   |     |  2 byte   |       |     |
+//	+----------+-----------+-----+-----------+-------+-----+
+package listenrain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	ErrMultiplexRequired = errors.New("protocol type is not Multiplex")
+)
+
+type Metadata map[string]string
+
+func (md Metadata) size() (int, error) {
+	if len(md) > math.MaxUint16 {
+		return 0, fmt.Errorf("metadata count:%d exceeds the max:%d", len(md), math.MaxUint16)
+	}
+
+	size := 2
+	for k, v := range md {
+		if len(k) > math.MaxUint16 || len(v) > math.MaxUint16 {
+			return 0, fmt.Errorf("metadata %s size exceeds the max:%d", k, math.MaxUint16)
+		}
+		size += 4 + len(k) + len(v)
+	}
+	return size, nil
+}
+
+// buf must be of md.size()
+func (md Metadata) encode(buf []byte) {
+	binary.BigEndian.PutUint16(buf, uint16(len(md)))
+	n := 2
+	for k, v := range md {
+		binary.BigEndian.PutUint16(buf[n:], uint16(len(k)))
+		n += 2
+		n += copy(buf[n:], k)
+		binary.BigEndian.PutUint16(buf[n:], uint16(len(v)))
+		n += 2
+		n += copy(buf[n:], v)
+	}
+}
+
+// return the metadata and the bytes consumed, the strings are copied,
+// the payload buffer may be released
+func decodeMetadata(buf []byte) (Metadata, int, error) {
+	if len(buf) < 2 {
+		return nil, 0, fmt.Errorf("%w, metadata size:%d", ErrInvalidFrame, len(buf))
+	}
+
+	// each entry takes 4 bytes at least, don't trust the count before the map is sized by it
+	count := int(binary.BigEndian.Uint16(buf))
+	if count > (len(buf)-2)/4 {
+		return nil, 0, fmt.Errorf("%w, metadata count:%d, left:%d", ErrInvalidFrame, count, len(buf)-2)
+	}
+
+	md := make(Metadata, count)
+	n := 2
+	for i := 0; i < count; i++ {
+		k, size, err := decodeMetadataString(buf[n:])
+		if err != nil {
+			return nil, 0, err
+		}
+		n += size
+
+		v, size, err := decodeMetadataString(buf[n:])
+		if err != nil {
+			return nil, 0, err
+		}
+		n += size
+
+		md[k] = v
+	}
+	return md, n, nil
+}
+
+func decodeMetadataString(buf []byte) (string, int, error) {
+	if len(buf) < 2 {
+		return "", 0, fmt.Errorf("%w, metadata is truncated", ErrInvalidFrame)
+	}
+
+	size := int(binary.BigEndian.Uint16(buf))
+	if 2+size > len(buf) {
+		return "", 0, fmt.Errorf("%w, metadata string size:%d, left:%d", ErrInvalidFrame, size, len(buf)-2)
+	}
+	return string(buf[2 : 2+size]), 2 + size, nil
+}
+
+// Attach the metadata to the message, it requires the Multiplex protocol type
+func WithMetadata(md Metadata) SendOption {
+	return func(so *sendOptions) {
+		so.md = md
+	}
+}
+
+// Implemented by the ServerResponse of the Multiplex protocol type
+type MetadataResponse interface {
+	ServerResponse
+	// metadata of the request
+	Metadata() Metadata
+	ResponseWithMetadata(message interface{}, md Metadata) error
+}
+
+// Optional interface of the StatMachine to receive the metadata of the
+// response, ProcessMetadata is called instead of Process
+type MetadataStatMachine interface {
+	StatMachine
+	ProcessMetadata(msgId string, md Metadata, v interface{})
+}
+
+// The metadata of the request, nil if the protocol type is not Multiplex
+func MetadataOf(response ServerResponse) Metadata {
+	if mr, ok := response.(MetadataResponse); ok {
+		return mr.Metadata()
+	}
+	return nil
+}
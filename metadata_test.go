@@ -0,0 +1,136 @@
+package listenrain
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetadataFrameRoundTrip(t *testing.T) {
+	md := Metadata{"trace": "t-1", "tenant": "", "": "empty key"}
+	frame, err := encodeFrame(&frameHeader{kind: FRAME_REQUEST, reqId: 3, timeout: time.Second, md: md}, []byte("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, body, err := decodeFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.flags != FRAME_FLAG_METADATA|FRAME_FLAG_DEADLINE || h.timeout != time.Second {
+		t.Fatalf("unexpected header %+v", h)
+	}
+
+	if !reflect.DeepEqual(h.md, md) || string(body) != "body" {
+		t.Fatalf("unexpected metadata %v, body %q", h.md, body)
+	}
+}
+
+func TestMetadataTruncated(t *testing.T) {
+	frame, err := encodeFrame(&frameHeader{kind: FRAME_REQUEST, md: Metadata{"key": "value"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for size := FRAME_HEAD_BYTE_SIZE; size < len(frame); size++ {
+		if _, _, err := decodeFrame(frame[:size]); !errors.Is(err, ErrInvalidFrame) {
+			t.Fatalf("size:%d, expect ErrInvalidFrame, got %v", size, err)
+		}
+	}
+}
+
+// the count of the entries can't exceed what the buffer holds
+func TestDecodeMetadataCount(t *testing.T) {
+	buf := []byte{0xff, 0xff, 0, 0, 0, 0}
+	if _, _, err := decodeMetadata(buf); !errors.Is(err, ErrInvalidFrame) {
+		t.Fatalf("expect ErrInvalidFrame, got %v", err)
+	}
+
+	// one entry of the empty key and value
+	md, n, err := decodeMetadata([]byte{0, 1, 0, 0, 0, 0})
+	if err != nil || n != 6 || len(md) != 1 {
+		t.Fatalf("unexpected metadata %v, %d, %v", md, n, err)
+	}
+}
+
+func TestMetadataOversize(t *testing.T) {
+	md := Metadata{"key": strings.Repeat("v", math.MaxUint16+1)}
+	if _, err := encodeFrame(&frameHeader{kind: FRAME_REQUEST, md: md}, nil); err == nil {
+		t.Fatal("expect the error of the value size")
+	}
+}
+
+func TestSendMetadataRequiresMultiplex(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	key := testServer(t, testEchoRouter, nil)
+	ptyp := testClient(lr, nil)
+
+	_, err := lr.SyncSend(ptyp, key, "a:1", WithMetadata(Metadata{"trace": "t-1"}))
+	if !errors.Is(err, ErrMultiplexRequired) {
+		t.Fatalf("expect ErrMultiplexRequired, got %v", err)
+	}
+}
+
+// reports the metadata of the responses
+type testMetadataStatMachine struct {
+	*testStatMachine
+	mds chan Metadata
+}
+
+func (sm *testMetadataStatMachine) ProcessMetadata(msgId string, md Metadata, v interface{}) {
+	sm.mds <- md
+	sm.Process(msgId, v)
+}
+
+// the router reads the metadata of the request and answers with its own
+func TestMetadataRoundTrip(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	mux := func(pt *protocolType) { pt.Multiplex = true }
+	key := testServer(t, func(response ServerResponse, msgId string, cmd int, message interface{}) error {
+		md := MetadataOf(response)
+		return response.(MetadataResponse).ResponseWithMetadata(message, Metadata{"echo": md["trace"]})
+	}, mux)
+	ptyp := testClient(lr, mux)
+
+	sm := &testMetadataStatMachine{testStatMachine: newTestStatMachine(), mds: make(chan Metadata, 1)}
+	if err := lr.Send(ptyp, sm, key, "a:1", WithMetadata(Metadata{"trace": "t-1"})); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case md := <-sm.mds:
+		if md["echo"] != "t-1" {
+			t.Fatalf("unexpected metadata %v", md)
+		}
+	case <-time.After(testTimeout()):
+		t.Fatal("response timeout")
+	}
+
+	if v := <-sm.results; v != "a:1" {
+		t.Fatalf("unexpected response %v", v)
+	}
+}
+
+func TestMetadataOfNonMultiplex(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	key := testServer(t, func(response ServerResponse, msgId string, cmd int, message interface{}) error {
+		if md := MetadataOf(response); md != nil {
+			return response.Response("unexpected metadata")
+		}
+		return response.Response(message)
+	}, nil)
+	ptyp := testClient(lr, nil)
+
+	v, err := lr.SyncSend(ptyp, key, "a:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != "a:1" {
+		t.Fatalf("unexpected response %v", v)
+	}
+}
@@ -0,0 +1,287 @@
+// The multiplexing layer managed by the framework. When a protocol
+// enables Multiplex, the payload returned by EncodeMessage is prefixed
+// with a frame header carrying a per-transport monotonic request id,
+// so the framework correlates responses by itself and the EnDecMessage
+// implementation only has to deal with the message body.
+package listenrain
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	FRAME_HEAD_BYTE_SIZE = 10
+)
+
+type FrameKind uint8
+
+const (
+	FRAME_REQUEST FrameKind = iota
+	FRAME_RESPONSE
+	// the response of the failed request, the body is the RemoteError
+	FRAME_ERROR
+	// the heartbeats, without body
+	FRAME_PING
+	FRAME_PONG
+)
+
+// bits of the flags of the frame header
+const (
+	// the metadata follows the frame header
+	FRAME_FLAG_METADATA uint8 = 1 << iota
+	// the time left of the request follows the frame header, in milliseconds
+	FRAME_FLAG_DEADLINE
+)
+
+const (
+	FRAME_DEADLINE_BYTE_SIZE = 4
+)
+
+var (
+	ErrInvalidFrame = errors.New("invalid multiplex frame")
+	// Only the first response of a request is sent
+	ErrResponded = errors.New("request has been responded")
+)
+
+// format:
+//
+//	+--------+--------+-----------------------+-----------------+
+//	|  kind  | flags  |      request id       |      body       |
+//	+--------+--------+-----------------------+-----------------+
+//	| 1 byte | 1 byte | 8 byte (big endian)   |   left bytes    |
+//	+--------+--------+-----------------------+-----------------+
+//
+// the optional fields are between the header and the body, in the order
+// of deadline (4 byte, big endian) and metadata, as the flags tell
+type frameHeader struct {
+	kind  FrameKind
+	flags uint8
+	reqId uint64
+	// relative, the clocks of both side may differ
+	timeout time.Duration
+	md      Metadata
+}
+
+func encodeTimeout(d time.Duration) uint32 {
+	ms := (d + time.Millisecond - 1) / time.Millisecond
+	if ms < 1 {
+		return 1
+	}
+	if ms > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(ms)
+}
+
+func encodeFrame(h *frameHeader, body []byte) ([]byte, error) {
+	var (
+		flags  = h.flags &^ (FRAME_FLAG_METADATA | FRAME_FLAG_DEADLINE)
+		dlSize int
+		mdSize int
+		err    error
+	)
+	if h.timeout > 0 {
+		dlSize = FRAME_DEADLINE_BYTE_SIZE
+		flags |= FRAME_FLAG_DEADLINE
+	}
+
+	if len(h.md) > 0 {
+		mdSize, err = h.md.size()
+		if err != nil {
+			return nil, err
+		}
+		flags |= FRAME_FLAG_METADATA
+	}
+
+	frame := make([]byte, FRAME_HEAD_BYTE_SIZE+dlSize+mdSize+len(body))
+	frame[0] = byte(h.kind)
+	frame[1] = flags
+	binary.BigEndian.PutUint64(frame[2:FRAME_HEAD_BYTE_SIZE], h.reqId)
+	n := FRAME_HEAD_BYTE_SIZE
+	if dlSize > 0 {
+		binary.BigEndian.PutUint32(frame[n:n+dlSize], encodeTimeout(h.timeout))
+		n += dlSize
+	}
+
+	if mdSize > 0 {
+		h.md.encode(frame[n : n+mdSize])
+		n += mdSize
+	}
+	copy(frame[n:], body)
+	return frame, nil
+}
+
+func decodeFrame(payload []byte) (h frameHeader, body []byte, err error) {
+	if len(payload) < FRAME_HEAD_BYTE_SIZE {
+		return h, nil, fmt.Errorf("%w, size:%d", ErrInvalidFrame, len(payload))
+	}
+
+	h.kind = FrameKind(payload[0])
+	h.flags = payload[1]
+	h.reqId = binary.BigEndian.Uint64(payload[2:FRAME_HEAD_BYTE_SIZE])
+	body = payload[FRAME_HEAD_BYTE_SIZE:]
+	if h.flags&FRAME_FLAG_DEADLINE != 0 {
+		if len(body) < FRAME_DEADLINE_BYTE_SIZE {
+			return h, nil, fmt.Errorf("%w, deadline is truncated", ErrInvalidFrame)
+		}
+		h.timeout = time.Duration(binary.BigEndian.Uint32(body)) * time.Millisecond
+		body = body[FRAME_DEADLINE_BYTE_SIZE:]
+	}
+
+	if h.flags&FRAME_FLAG_METADATA != 0 {
+		var n int
+		h.md, n, err = decodeMetadata(body)
+		if err != nil {
+			return h, nil, err
+		}
+		body = body[n:]
+	}
+	return h, body, nil
+}
+
+// The msgId handed to callbacks in multiplex mode is the request id in decimal
+func formatReqId(reqId uint64) string {
+	return strconv.FormatUint(reqId, 10)
+}
+
+type muxEntry struct {
+	sm       StatMachine
+	deadline time.Time
+}
+
+// state machines indexed by request id, no string allocation per message
+type muxStatMachinePool struct {
+	mtx sync.Mutex
+	c   map[uint64]muxEntry
+}
+
+func newMuxStatMachinePool() *muxStatMachinePool {
+	return &muxStatMachinePool{
+		c: make(map[uint64]muxEntry),
+	}
+}
+
+func (p *muxStatMachinePool) Put(reqId uint64, sm StatMachine, deadline time.Time) {
+	p.mtx.Lock()
+	p.c[reqId] = muxEntry{sm: sm, deadline: deadline}
+	p.mtx.Unlock()
+}
+
+func (p *muxStatMachinePool) Pop(reqId uint64) StatMachine {
+	p.mtx.Lock()
+	e := p.c[reqId]
+	delete(p.c, reqId)
+	p.mtx.Unlock()
+	return e.sm
+}
+
+// the deadline of the request, false if it has been popped
+func (p *muxStatMachinePool) Deadline(reqId uint64) (time.Time, bool) {
+	p.mtx.Lock()
+	e, ok := p.c[reqId]
+	p.mtx.Unlock()
+	return e.deadline, ok
+}
+
+// ServerResponse bound to one request of a multiplexed server transport
+type multiplexResponse struct {
+	// set once responded, first field for the alignment of atomic
+	responded int32
+	t         *serverTransport
+	reqId     uint64
+	md        Metadata
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// the deadline counts from receivedAt, the time waited for the executor
+// or the rate limits is not given to the router again
+func newMultiplexResponse(t *serverTransport, h *frameHeader, receivedAt time.Time) *multiplexResponse {
+	r := &multiplexResponse{
+		t:     t,
+		reqId: h.reqId,
+		md:    h.md,
+	}
+
+	if h.timeout > 0 {
+		r.ctx, r.cancel = context.WithDeadline(t.ctx, receivedAt.Add(h.timeout))
+	} else {
+		r.ctx, r.cancel = context.WithCancel(t.ctx)
+	}
+	return r
+}
+
+// the router returned, the responder going on asynchronously has to
+// derive its own context
+func (r *multiplexResponse) release() {
+	r.cancel()
+}
+
+func (r *multiplexResponse) Response(message interface{}) error {
+	return r.ResponseWithMetadata(message, nil)
+}
+
+// done when the deadline of the client passes, the connection closes, the
+// response is sent or the router returns
+func (r *multiplexResponse) Context() context.Context {
+	return r.ctx
+}
+
+func (r *multiplexResponse) Metadata() Metadata {
+	return r.md
+}
+
+func (r *multiplexResponse) ResponseWithMetadata(message interface{}, md Metadata) error {
+	payload, _, err := r.t.edM.EncodeMessage(message)
+	if err != nil {
+		return err
+	}
+	return r.send(FRAME_RESPONSE, payload, md)
+}
+
+func (r *multiplexResponse) ResponseError(code int, message string) error {
+	return r.send(FRAME_ERROR, encodeRemoteError(code, message), nil)
+}
+
+// the first one sending the response of the request wins, the router
+// responding asynchronously races with the framework failing it
+func (r *multiplexResponse) send(kind FrameKind, body []byte, md Metadata) error {
+	if r.t.close {
+		return fmt.Errorf("channel of to [%s] is closed", r.t.ch.PeerInfo())
+	}
+
+	frame, err := encodeFrame(&frameHeader{kind: kind, reqId: r.reqId, md: md}, body)
+	if err != nil {
+		return err
+	}
+
+	if !atomic.CompareAndSwapInt32(&r.responded, 0, 1) {
+		return ErrResponded
+	}
+	// nobody waits for the work of the request anymore
+	defer r.release()
+	return r.t.q.PushContext(context.Background(), frame)
+}
+
+// respond the error of the router, unless the router has responded, so
+// the client fails immediately instead of waiting for the timeout
+func (r *multiplexResponse) fail(err error) {
+	rerr := remoteErrorOf(err)
+	err = r.ResponseError(rerr.Code, rerr.Message)
+	if err != nil && err != ErrResponded {
+		log.Printf("server transport reqId:%d response error, %s", r.reqId, err)
+	}
+}
+
+func (r *multiplexResponse) Close() {
+	r.t.Close()
+}
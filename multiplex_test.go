@@ -0,0 +1,181 @@
+package listenrain
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	frame, err := encodeFrame(&frameHeader{kind: FRAME_RESPONSE, reqId: 1<<40 + 7}, []byte("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(frame) != FRAME_HEAD_BYTE_SIZE+4 {
+		t.Fatalf("frame size %d", len(frame))
+	}
+
+	h, body, err := decodeFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.kind != FRAME_RESPONSE || h.reqId != 1<<40+7 || !bytes.Equal(body, []byte("body")) {
+		t.Fatalf("unexpected frame %+v %q", h, body)
+	}
+}
+
+func TestDecodeFrameTruncated(t *testing.T) {
+	_, _, err := decodeFrame(make([]byte, FRAME_HEAD_BYTE_SIZE-1))
+	if !errors.Is(err, ErrInvalidFrame) {
+		t.Fatalf("expect ErrInvalidFrame, got %v", err)
+	}
+}
+
+// the msgId of the messages is the same, the framework correlates the responses by itself
+func TestMultiplexCorrelatesReusedMsgId(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	mux := func(pt *protocolType) { pt.Multiplex = true }
+	key := testServer(t, testEchoRouter, mux)
+	ptyp := testClient(lr, mux)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg := fmt.Sprintf("same:%d", i)
+			v, err := lr.SyncSend(ptyp, key, msg)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			if v != msg {
+				errs <- fmt.Errorf("expect %s, got %v", msg, v)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestStampDeadline(t *testing.T) {
+	tr := &Transport{muxPool: newMuxStatMachinePool()}
+	frame, err := encodeFrame(&frameHeader{kind: FRAME_REQUEST, reqId: 1, timeout: time.Minute}, []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the time left at write time is stamped, not the timeout at Send time
+	tr.muxPool.Put(1, newTestStatMachine(), time.Now().Add(time.Second))
+	if !tr.stampDeadline(frame) {
+		t.Fatal("expect the request sent")
+	}
+
+	if ms := binary.BigEndian.Uint32(frame[FRAME_HEAD_BYTE_SIZE:]); ms > 1000 || ms < 900 {
+		t.Fatalf("expect about 1000ms left, got %d", ms)
+	}
+
+	// timed out or taken back
+	tr.muxPool.Pop(1)
+	if tr.stampDeadline(frame) {
+		t.Fatal("expect the request gone not sent")
+	}
+
+	ping, err := encodeFrame(&frameHeader{kind: FRAME_PING, reqId: 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !tr.stampDeadline(ping) {
+		t.Fatal("expect the frame without deadline sent")
+	}
+}
+
+func TestRouterContextDeadline(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	mux := func(pt *protocolType) { pt.Multiplex = true }
+	key := testServer(t, func(response ServerResponse, msgId string, cmd int, message interface{}) error {
+		deadline, ok := ContextOf(response).Deadline()
+		if !ok || time.Until(deadline) > time.Second {
+			return response.Response("bad:deadline")
+		}
+		return response.Response(message)
+	}, mux)
+	ptyp := testClient(lr, mux)
+
+	v, err := lr.SyncSend(ptyp, key, "a:1", WithTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != "a:1" {
+		t.Fatalf("unexpected response %v", v)
+	}
+}
+
+// the context of the request is done once the router returns, not at the deadline
+func TestRouterContextCanceledOnReturn(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	mux := func(pt *protocolType) { pt.Multiplex = true }
+	ctxs := make(chan context.Context, 1)
+	key := testServer(t, func(response ServerResponse, msgId string, cmd int, message interface{}) error {
+		ctxs <- ContextOf(response)
+		return nil
+	}, mux)
+	ptyp := testClient(lr, mux)
+
+	if err := lr.Send(ptyp, newTestStatMachine(), key, "a:1", WithTimeout(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the request without a timeout has its own context as well
+	c, err := net.Dial("tcp", key.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	frame, err := encodeFrame(&frameHeader{kind: FRAME_REQUEST, reqId: 1}, []byte("b:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&DefaultEnDecPacket{}).EncodePacket(c, frame); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		ctx := <-ctxs
+		select {
+		case <-ctx.Done():
+		case <-time.After(testTimeout()):
+			t.Fatalf("request %d, the context is not canceled after the router returns", i)
+		}
+	}
+}
+
+// the time waited before the router runs is taken from the deadline
+func TestMultiplexResponseDeadlineFromReceivedAt(t *testing.T) {
+	tr := &serverTransport{ctx: context.Background()}
+	receivedAt := time.Now().Add(-time.Second)
+	r := newMultiplexResponse(tr, &frameHeader{kind: FRAME_REQUEST, reqId: 1, timeout: 2 * time.Second}, receivedAt)
+	defer r.release()
+
+	deadline, ok := r.Context().Deadline()
+	if !ok || !deadline.Equal(receivedAt.Add(2*time.Second)) {
+		t.Fatalf("expect the deadline of %s, got %s", receivedAt.Add(2*time.Second), deadline)
+	}
+}
@@ -0,0 +1,148 @@
+package listenrain
+
+import (
+	"sync"
+)
+
+const (
+	DEFAULT_ORDERED_LANES   = 1 << 10 // 1024
+	DEFAULT_ORDERED_BACKLOG = 1 << 10 // 1024
+)
+
+// Implemented by the message processed by the OrderedExecutor in the order
+// of its key, such as the session id of a stateful command, instead of the
+// order of its connection
+type PartitionKeyer interface {
+	PartitionKey() string
+}
+
+// the runner decoding the message ahead to get its partition key
+type partitionRunner interface {
+	partitionKey(payload []byte) interface{}
+}
+
+// The packets of the same key are processed one by one in the order they
+// are received, the packets of different keys in parallel. The key is the
+// PartitionKey of the request of the server, otherwise the connection. A
+// lane of a key lives while its packets are processed, the receive loop
+// waits when MaxLanes keys are busy, or when MaxBacklog packets are queued
+// in the lane of the key.
+type OrderedExecutor struct {
+	// <= 0 means DEFAULT_ORDERED_LANES
+	MaxLanes int
+	// packets queued per lane behind the running one, <= 0 means DEFAULT_ORDERED_BACKLOG
+	MaxBacklog int
+
+	mtx   sync.Mutex
+	cond  *sync.Cond
+	lanes map[interface{}]*orderedLane
+}
+
+// the packets queued behind the running one of the key
+type orderedLane struct {
+	tasks []executorTask
+}
+
+func NewOrderedExecutor(maxLanes, maxBacklog int) *OrderedExecutor {
+	e := &OrderedExecutor{
+		MaxLanes:   maxLanes,
+		MaxBacklog: maxBacklog,
+		lanes:      make(map[interface{}]*orderedLane),
+	}
+	e.cond = sync.NewCond(&e.mtx)
+	return e
+}
+
+func (e *OrderedExecutor) maxLanes() int {
+	if e.MaxLanes <= 0 {
+		return DEFAULT_ORDERED_LANES
+	}
+	return e.MaxLanes
+}
+
+func (e *OrderedExecutor) maxBacklog() int {
+	if e.MaxBacklog <= 0 {
+		return DEFAULT_ORDERED_BACKLOG
+	}
+	return e.MaxBacklog
+}
+
+func (e *OrderedExecutor) Process(r processRunner, payload []byte) {
+	var key interface{} = r
+	if pr, ok := r.(partitionRunner); ok {
+		key = pr.partitionKey(payload)
+	}
+
+	task := executorTask{pr: r, payload: payload}
+	e.mtx.Lock()
+	for {
+		if l, ok := e.lanes[key]; ok {
+			if len(l.tasks) < e.maxBacklog() {
+				l.tasks = append(l.tasks, task)
+				e.mtx.Unlock()
+				return
+			}
+		} else if len(e.lanes) < e.maxLanes() {
+			break
+		}
+		// the waiters of a lane and of the room for a lane share the cond
+		e.cond.Wait()
+	}
+
+	l := &orderedLane{}
+	e.lanes[key] = l
+	e.mtx.Unlock()
+	go e.drain(key, l, task)
+}
+
+// the timeouts are not ordered
+func (e *OrderedExecutor) Timeout(r timeoutRunner, msgId string) {
+	go func() {
+		r.Timeout(msgId)
+	}()
+}
+
+func (e *OrderedExecutor) drain(key interface{}, l *orderedLane, task executorTask) {
+	for {
+		task.run()
+
+		e.mtx.Lock()
+		if len(l.tasks) == 0 {
+			delete(e.lanes, key)
+			e.cond.Broadcast()
+			e.mtx.Unlock()
+			return
+		}
+
+		full := len(l.tasks) >= e.maxBacklog()
+		task = l.tasks[0]
+		l.tasks[0] = executorTask{} // help gc
+		l.tasks = l.tasks[1:]
+		if full {
+			e.cond.Broadcast()
+		}
+		e.mtx.Unlock()
+	}
+}
+
+// number of the keys being processed, for metrics
+func (e *OrderedExecutor) Len() int {
+	e.mtx.Lock()
+	n := len(e.lanes)
+	e.mtx.Unlock()
+	return n
+}
+
+// the packets of one connection are processed in order
+func OrderedExecutorGenerator(key TransportKey) (Executor, error) {
+	return NewOrderedExecutor(DEFAULT_ORDERED_LANES, DEFAULT_ORDERED_BACKLOG), nil
+}
+
+// all the transports of the generator share one executor, so the
+// partition key orders the packets across the connections
+func NewSharedOrderedExecutorGenerator(maxLanes, maxBacklog int) func(TransportKey) (Executor, error) {
+	e := NewOrderedExecutor(maxLanes, maxBacklog)
+	return func(key TransportKey) (Executor, error) {
+		return e, nil
+	}
+}
@@ -0,0 +1,225 @@
+package listenrain
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// records the order of the payloads, each one runs a while
+type orderRunner struct {
+	mtx   sync.Mutex
+	order []string
+	wg    sync.WaitGroup
+}
+
+func (r *orderRunner) Process(payload []byte) {
+	time.Sleep(time.Duration(len(payload)%3) * time.Millisecond)
+	r.mtx.Lock()
+	r.order = append(r.order, string(payload))
+	r.mtx.Unlock()
+	r.wg.Done()
+}
+
+// the key is the part of the payload before the colon
+type keyedRunner struct {
+	*orderRunner
+}
+
+func (r keyedRunner) partitionKey(payload []byte) interface{} {
+	return testMsgId(string(payload))
+}
+
+func TestOrderedExecutorConnectionOrder(t *testing.T) {
+	e := NewOrderedExecutor(0, 0)
+	r := &orderRunner{}
+	var expect []string
+	for i := 0; i < 50; i++ {
+		p := fmt.Sprintf("p%d", i)
+		expect = append(expect, p)
+		r.wg.Add(1)
+		e.Process(r, []byte(p))
+	}
+	r.wg.Wait()
+
+	if got := strings.Join(r.order, ","); got != strings.Join(expect, ",") {
+		t.Fatalf("unexpected order %s", got)
+	}
+}
+
+// the keys are ordered across the runners
+func TestOrderedExecutorPartitionKey(t *testing.T) {
+	e := NewOrderedExecutor(0, 0)
+	r := &orderRunner{}
+	for i := 0; i < 20; i++ {
+		for _, key := range []string{"a", "b"} {
+			r.wg.Add(1)
+			// a runner per packet, as the server transport does
+			e.Process(keyedRunner{r}, []byte(fmt.Sprintf("%s:%02d", key, i)))
+		}
+	}
+	r.wg.Wait()
+
+	last := map[string]string{}
+	for _, p := range r.order {
+		key := testMsgId(p)
+		if p < last[key] {
+			t.Fatalf("%s after %s", p, last[key])
+		}
+		last[key] = p
+	}
+
+	if e.Len() != 0 {
+		t.Fatalf("expect the idle lanes removed, got %d", e.Len())
+	}
+}
+
+// blocks the lane until release is closed
+type blockingKeyedRunner struct {
+	release chan struct{}
+	started chan string
+}
+
+func (r *blockingKeyedRunner) Process(payload []byte) {
+	r.started <- string(payload)
+	<-r.release
+}
+
+func (r *blockingKeyedRunner) partitionKey(payload []byte) interface{} {
+	return string(payload)
+}
+
+func TestOrderedExecutorMaxLanes(t *testing.T) {
+	e := NewOrderedExecutor(1, 0)
+	r := &blockingKeyedRunner{release: make(chan struct{}), started: make(chan string, 2)}
+	e.Process(r, []byte("a"))
+	<-r.started
+
+	done := make(chan struct{})
+	go func() {
+		e.Process(r, []byte("b"))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("the second lane is opened beyond MaxLanes")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// the lane of a busy key takes more packets
+	e.Process(r, []byte("a"))
+
+	close(r.release)
+	<-done
+	for i := 0; i < 2; i++ {
+		<-r.started
+	}
+}
+
+func TestOrderedExecutorMaxBacklog(t *testing.T) {
+	e := NewOrderedExecutor(0, 1)
+	r := &blockingKeyedRunner{release: make(chan struct{}), started: make(chan string, 3)}
+	e.Process(r, []byte("a"))
+	<-r.started
+	// queued behind the running one
+	e.Process(r, []byte("a"))
+
+	done := make(chan struct{})
+	go func() {
+		e.Process(r, []byte("a"))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("the packet is queued beyond MaxBacklog")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(r.release)
+	<-done
+	for i := 0; i < 2; i++ {
+		<-r.started
+	}
+}
+
+// the message of the session processed in order
+type testSessionMessage string
+
+func (m testSessionMessage) PartitionKey() string {
+	return testMsgId(string(m))
+}
+
+type testSessionCodec struct {
+	testCodec
+}
+
+func (testSessionCodec) DecodeMessage(payload []byte) (interface{}, string, error) {
+	s := string(payload)
+	return testSessionMessage(s), testMsgId(s), nil
+}
+
+func TestOrderedExecutorSessionRequests(t *testing.T) {
+	var (
+		mtx     sync.Mutex
+		running = map[string]int{}
+		overlap int32
+		maxRun  int32
+		total   int32
+	)
+	mux := func(pt *protocolType) {
+		pt.Multiplex = true
+		pt.EdM = testSessionCodec{}
+	}
+	lr := NewListenRain(NewDefaultTransportPool())
+	key := testServer(t, func(response ServerResponse, msgId string, cmd int, message interface{}) error {
+		session := message.(testSessionMessage).PartitionKey()
+		mtx.Lock()
+		running[session]++
+		if running[session] > 1 {
+			atomic.StoreInt32(&overlap, 1)
+		}
+		if n := atomic.AddInt32(&total, 1); n > atomic.LoadInt32(&maxRun) {
+			atomic.StoreInt32(&maxRun, n)
+		}
+		mtx.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mtx.Lock()
+		running[session]--
+		atomic.AddInt32(&total, -1)
+		mtx.Unlock()
+		return response.Response(string(message.(testSessionMessage)))
+	}, func(pt *protocolType) {
+		mux(pt)
+		pt.ExecutorGenerator = NewSharedOrderedExecutorGenerator(0, 0)
+	})
+	ptyp := testClient(lr, mux)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		for _, session := range []string{"s1", "s2", "s3"} {
+			wg.Add(1)
+			go func(msg string) {
+				defer wg.Done()
+				if _, err := lr.SyncSend(ptyp, key, msg); err != nil {
+					t.Error(err)
+				}
+			}(fmt.Sprintf("%s:%d", session, i))
+		}
+	}
+	wg.Wait()
+
+	if atomic.LoadInt32(&overlap) != 0 {
+		t.Fatal("the requests of one session overlap")
+	}
+
+	if atomic.LoadInt32(&maxRun) < 2 {
+		t.Fatal("the sessions are not processed in parallel")
+	}
+}
@@ -0,0 +1,93 @@
+package listenrain
+
+import (
+	"io"
+)
+
+// The buffer lifecycle and the size limit shared by the EnDecPacket
+// implementations of the alternative framings
+type PacketOptions struct {
+	AllocatePacketBuffer func(size uint32) ([]byte, error)
+	// takes back the buffer of AllocatePacketBuffer, see PacketBufferReleaser
+	ReleasePacketBuffer func(buf []byte)
+	// Max payload size of both encode and decode, 0 means DEFAULT_MAX_PACKET_SIZE,
+	// math.MaxUint32 means no limit
+	MaxPacketSize uint32
+}
+
+// the size is at most 4GiB, the AllocatePacketBuffer takes uint32
+func (o *PacketOptions) checkSize(size uint64) error {
+	if max := packetSizeLimit(o.MaxPacketSize); size > max {
+		return &PacketSizeError{Size: size, Max: max}
+	}
+	return nil
+}
+
+// the framings whose header depends on more than the size override it
+func (o *PacketOptions) CheckPacket(payload []byte) error {
+	return o.checkSize(uint64(len(payload)))
+}
+
+func (o *PacketOptions) allocate(size uint32) ([]byte, error) {
+	if o.AllocatePacketBuffer == nil {
+		return defaultAllocatePacketBuffer(size)
+	}
+	return o.AllocatePacketBuffer(size)
+}
+
+func (o *PacketOptions) ReleasePacket(buf []byte) {
+	if o.ReleasePacketBuffer != nil {
+		o.ReleasePacketBuffer(buf)
+	}
+}
+
+// check size, allocate and read the body of size
+func (o *PacketOptions) readBody(r io.Reader, size uint64) ([]byte, error) {
+	if err := o.checkSize(size); err != nil {
+		return nil, err
+	}
+
+	buf, err := o.allocate(uint32(size))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		o.ReleasePacket(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// The transport decodes from a buffered reader, unless ReadBufferSize of
+// the protocol is negative, then the bytes are read one by one
+type oneByteReader struct {
+	r io.Reader
+	b [1]byte
+}
+
+func (o *oneByteReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(o.r, o.b[:])
+	return o.b[0], err
+}
+
+func asByteReader(r io.Reader) io.ByteReader {
+	if br, ok := r.(io.ByteReader); ok {
+		return br
+	}
+	return &oneByteReader{r: r}
+}
+
+// write until the whole buf is written
+func writeFull(w io.Writer, buf []byte) error {
+	var offset int
+	for offset < len(buf) {
+		n, err := w.Write(buf[offset:])
+		offset += n
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package listenrain
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	PRIORITY_HIGH = iota
+	PRIORITY_NORMAL
+	PRIORITY_LOW
+)
+
+var (
+	// pops per round of each priority level
+	DEFAULT_PRIORITY_WEIGHTS = []int{8, 4, 1}
+)
+
+type priorityLevel struct {
+	items  [][]byte
+	weight int
+	credit int
+}
+
+// PriorityQueue keeps one FIFO per priority level, lower level is higher
+// priority. Pop runs weighted rounds, each level pops at most its weight
+// per round, so low priority traffic still progresses behind the bulk of
+// high priority traffic, and small control messages aren't starved by a
+// bulk transfer queued at a lower priority.
+type PriorityQueue struct {
+	mtx      sync.Mutex
+	levels   []priorityLevel
+	maxItems int // per level
+	size     int
+	closed   bool
+	// closed and renewed to wake up the waiters
+	notEmpty chan struct{}
+	notFull  chan struct{}
+}
+
+// weights[i] is the weight of priority i, maxItems is the capacity of each level
+func NewPriorityQueue(weights []int, maxItems int) *PriorityQueue {
+	if len(weights) == 0 {
+		weights = DEFAULT_PRIORITY_WEIGHTS
+	}
+
+	if maxItems <= 0 {
+		maxItems = DEFAULT_QUEUE_CAP
+	}
+
+	q := &PriorityQueue{
+		levels:   make([]priorityLevel, len(weights)),
+		maxItems: maxItems,
+		notEmpty: make(chan struct{}),
+		notFull:  make(chan struct{}),
+	}
+
+	for i, w := range weights {
+		if w <= 0 {
+			w = 1
+		}
+		q.levels[i].weight = w
+		q.levels[i].credit = w
+	}
+	return q
+}
+
+func (q *PriorityQueue) level(priority int) *priorityLevel {
+	if priority < 0 {
+		priority = 0
+	} else if priority >= len(q.levels) {
+		priority = len(q.levels) - 1
+	}
+	return &q.levels[priority]
+}
+
+// call with lock held
+func (q *PriorityQueue) tryPush(payload []byte, priority int) (bool, error) {
+	if q.closed {
+		return false, ErrQueueClosed
+	}
+
+	l := q.level(priority)
+	if len(l.items) >= q.maxItems {
+		return false, nil
+	}
+
+	l.items = append(l.items, payload)
+	q.size++
+	close(q.notEmpty)
+	q.notEmpty = make(chan struct{})
+	return true, nil
+}
+
+// call with lock held and the queue is not empty
+func (q *PriorityQueue) pop() []byte {
+	for {
+		for i := range q.levels {
+			l := &q.levels[i]
+			if len(l.items) == 0 || l.credit <= 0 {
+				continue
+			}
+
+			payload := l.items[0]
+			l.items[0] = nil // help gc
+			l.items = l.items[1:]
+			l.credit--
+			q.size--
+			if !q.closed {
+				close(q.notFull)
+				q.notFull = make(chan struct{})
+			}
+			return payload
+		}
+
+		// every non-empty level has used up its credit, next round
+		for i := range q.levels {
+			q.levels[i].credit = q.levels[i].weight
+		}
+	}
+}
+
+func (q *PriorityQueue) PushPriority(ctx context.Context, payload []byte, priority int) error {
+	for {
+		q.mtx.Lock()
+		ok, err := q.tryPush(payload, priority)
+		notFull := q.notFull
+		q.mtx.Unlock()
+		if ok || err != nil {
+			return err
+		}
+
+		select {
+		case <-notFull:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (q *PriorityQueue) TryPushPriority(payload []byte, priority int) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	ok, err := q.tryPush(payload, priority)
+	if !ok && err == nil {
+		err = ErrQueueFull
+	}
+	return err
+}
+
+func (q *PriorityQueue) Push(payload []byte) {
+	q.PushPriority(context.Background(), payload, PRIORITY_NORMAL)
+}
+
+func (q *PriorityQueue) TryPush(payload []byte) error {
+	return q.TryPushPriority(payload, PRIORITY_NORMAL)
+}
+
+func (q *PriorityQueue) PushContext(ctx context.Context, payload []byte) error {
+	return q.PushPriority(ctx, payload, PRIORITY_NORMAL)
+}
+
+// return nil after Drop
+func (q *PriorityQueue) Pop() (payload []byte) {
+	for {
+		q.mtx.Lock()
+		if q.size > 0 {
+			payload = q.pop()
+			q.mtx.Unlock()
+			return payload
+		}
+
+		if q.closed {
+			q.mtx.Unlock()
+			return nil
+		}
+		notEmpty := q.notEmpty
+		q.mtx.Unlock()
+		<-notEmpty
+	}
+}
+
+func (q *PriorityQueue) PopBatch(buf [][]byte, latency time.Duration) int {
+	var (
+		n        int
+		deadline <-chan time.Time
+	)
+	for {
+		q.mtx.Lock()
+		for n < len(buf) && q.size > 0 {
+			buf[n] = q.pop()
+			n++
+		}
+
+		if n == len(buf) || (n > 0 && latency <= 0) || q.closed {
+			q.mtx.Unlock()
+			return n
+		}
+		notEmpty := q.notEmpty
+		q.mtx.Unlock()
+
+		if n == 0 {
+			<-notEmpty
+			continue
+		}
+
+		if deadline == nil {
+			t := time.NewTimer(latency)
+			defer t.Stop()
+			deadline = t.C
+		}
+
+		select {
+		case <-notEmpty:
+		case <-deadline:
+			return n
+		}
+	}
+}
+
+func (q *PriorityQueue) PopNoBlocking() (payload []byte) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.size == 0 {
+		return nil
+	}
+	return q.pop()
+}
+
+func (q *PriorityQueue) Drop() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	close(q.notEmpty)
+	close(q.notFull)
+}
+
+func (q *PriorityQueue) Len() int {
+	q.mtx.Lock()
+	n := q.size
+	q.mtx.Unlock()
+	return n
+}
+
+func NewPriorityQueueGenerator(weights []int, maxItems int) func(TransportKey) (Queue, error) {
+	return func(key TransportKey) (Queue, error) {
+		return NewPriorityQueue(weights, maxItems), nil
+	}
+}
+
+func PriorityQueueGenerator(key TransportKey) (Queue, error) {
+	return NewPriorityQueue(DEFAULT_PRIORITY_WEIGHTS, DEFAULT_QUEUE_CAP), nil
+}
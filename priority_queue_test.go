@@ -0,0 +1,63 @@
+package listenrain
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPriorityQueueWeightedRounds(t *testing.T) {
+	q := NewPriorityQueue([]int{2, 1}, 0)
+	for _, p := range []string{"h1", "h2", "h3", "h4"} {
+		q.PushPriority(context.Background(), []byte(p), PRIORITY_HIGH)
+	}
+	for _, p := range []string{"l1", "l2"} {
+		q.PushPriority(context.Background(), []byte(p), 1)
+	}
+
+	var order []string
+	for q.Len() > 0 {
+		order = append(order, string(q.Pop()))
+	}
+
+	if got := strings.Join(order, ","); got != "h1,h2,l1,h3,h4,l2" {
+		t.Fatalf("unexpected order %s", got)
+	}
+}
+
+func TestPriorityQueueClampPriority(t *testing.T) {
+	q := NewPriorityQueue(nil, 1)
+	if err := q.TryPushPriority([]byte("a"), 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// the out of range priority goes to the lowest level
+	if err := q.TryPushPriority([]byte("b"), PRIORITY_LOW); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expect ErrQueueFull, got %v", err)
+	}
+
+	if err := q.TryPushPriority([]byte("c"), -1); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := q.Pop(); string(p) != "c" {
+		t.Fatalf("expect the highest priority first, got %s", p)
+	}
+}
+
+func TestPriorityQueuePopBatch(t *testing.T) {
+	q := NewPriorityQueue(nil, 0)
+	for _, p := range []string{"a", "b", "c"} {
+		q.Push([]byte(p))
+	}
+
+	buf := make([][]byte, 2)
+	if n := q.PopBatch(buf, 0); n != 2 {
+		t.Fatalf("expect a full batch, got %d", n)
+	}
+
+	if n := q.PopBatch(buf, 0); n != 1 || string(buf[0]) != "c" {
+		t.Fatalf("expect the rest, got %d", n)
+	}
+}
@@ -0,0 +1,126 @@
+package listenrain
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRateLimited = errors.New("rate limit exceeded")
+)
+
+// The pluggable rate limiter of the server, see RateLimit
+type Limiter interface {
+	// take one token if there is, without waiting
+	Allow() bool
+	// take one token, waiting until there is or ctx is done
+	Wait(ctx context.Context) error
+}
+
+// The token bucket refilled at rate tokens per second, holding at most burst tokens
+type TokenBucket struct {
+	mtx    sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// burst <= 0 means 1
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst <= 0 {
+		burst = 1
+	}
+
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// must be called with mtx held
+func (b *TokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+func (b *TokenBucket) Allow() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	b.mtx.Lock()
+	b.refill(time.Now())
+	// reserve the token, the waiters queue up behind the debt
+	b.tokens--
+	deficit := -b.tokens
+	b.mtx.Unlock()
+	if deficit <= 0 {
+		return nil
+	}
+
+	if b.rate <= 0 {
+		b.giveBack()
+		return ErrRateLimited
+	}
+
+	tm := time.NewTimer(time.Duration(deficit / b.rate * float64(time.Second)))
+	defer tm.Stop()
+	select {
+	case <-tm.C:
+		return nil
+	case <-ctx.Done():
+		b.giveBack()
+		return ctx.Err()
+	}
+}
+
+func (b *TokenBucket) giveBack() {
+	b.mtx.Lock()
+	b.tokens++
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.mtx.Unlock()
+}
+
+// What the server does with the request exceeding the limit
+type LimitPolicy uint8
+
+const (
+	// wait for the token, the global and per connection limits stop
+	// reading the connection, the per command limit holds the executor
+	LIMIT_DELAY LimitPolicy = iota
+	// respond ERROR_CODE_OVERLOAD if the protocol type is Multiplex,
+	// otherwise drop the request
+	LIMIT_REJECT
+	// close the connection
+	LIMIT_CLOSE
+)
+
+// The limits of the requests of a server protocol type, set before Listen
+type RateLimit struct {
+	// shared by all the connections, nil means no limit
+	Global Limiter
+	// returns the limiter of each new connection, nil means no limit
+	PerConnection func() Limiter
+	// the limiter of each cmd (see CmdMethoder), shared by all the connections
+	PerCommand map[int]Limiter
+	Policy     LimitPolicy
+}
@@ -0,0 +1,138 @@
+package listenrain
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketAllow(t *testing.T) {
+	b := NewTokenBucket(100, 2)
+	if !b.Allow() || !b.Allow() {
+		t.Fatal("expect the burst allowed")
+	}
+
+	if b.Allow() {
+		t.Fatal("expect the empty bucket refused")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("expect the bucket refilled")
+	}
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	b := NewTokenBucket(50, 1)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := b.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the 2 tokens beyond the burst take 40ms
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Fatalf("expect the waiters queued up, got %s", elapsed)
+	}
+
+	// the canceled waiter gives its token back
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := b.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect context.Canceled, got %v", err)
+	}
+
+	if err := NewTokenBucket(0, 1).Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	zero := NewTokenBucket(0, 1)
+	zero.Allow()
+	if err := zero.Wait(context.Background()); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expect ErrRateLimited of the bucket never refilled, got %v", err)
+	}
+}
+
+func TestRateLimitReject(t *testing.T) {
+	var pt *protocolType
+	lr := NewListenRain(NewDefaultTransportPool())
+	key := testServer(t, testEchoRouter, func(p *protocolType) {
+		p.Multiplex = true
+		p.RateLimit = &RateLimit{Global: NewTokenBucket(0, 1), Policy: LIMIT_REJECT}
+		pt = p
+	})
+	ptyp := testClient(lr, func(p *protocolType) { p.Multiplex = true })
+
+	if _, err := lr.SyncSend(ptyp, key, "a:1"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := lr.SyncSend(ptyp, key, "b:2")
+	var rerr *RemoteError
+	if !errors.As(err, &rerr) || rerr.Code != ERROR_CODE_OVERLOAD {
+		t.Fatalf("expect ERROR_CODE_OVERLOAD, got %v", err)
+	}
+
+	if n := atomic.LoadUint64(&pt.limited); n != 1 {
+		t.Fatalf("expect 1 limited, got %d", n)
+	}
+}
+
+func TestRateLimitClose(t *testing.T) {
+	key := testServer(t, testEchoRouter, func(p *protocolType) {
+		p.RateLimit = &RateLimit{
+			PerConnection: func() Limiter { return NewTokenBucket(0, 1) },
+			Policy:        LIMIT_CLOSE,
+		}
+	})
+
+	conn, err := net.Dial("tcp", key.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	edp := &DefaultEnDecPacket{}
+	rd := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(testTimeout()))
+	if err := edp.EncodePacket(conn, []byte("a:1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if p, err := edp.DecodePacket(rd); err != nil || string(p) != "a:1" {
+		t.Fatalf("expect the first request served, got %q, %v", p, err)
+	}
+
+	if err := edp.EncodePacket(conn, []byte("b:2")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := edp.DecodePacket(rd); err != io.EOF {
+		t.Fatalf("expect the connection closed, got %v", err)
+	}
+}
+
+func TestRateLimitDelay(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	key := testServer(t, testEchoRouter, func(p *protocolType) {
+		p.RateLimit = &RateLimit{Global: NewTokenBucket(50, 1), Policy: LIMIT_DELAY}
+	})
+	ptyp := testClient(lr, nil)
+
+	start := time.Now()
+	for _, msg := range []string{"a:1", "b:2", "c:3"} {
+		if _, err := lr.SyncSend(ptyp, key, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Fatalf("expect the requests delayed, got %s", elapsed)
+	}
+}
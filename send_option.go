@@ -0,0 +1,92 @@
+package listenrain
+
+import (
+	"context"
+	"time"
+)
+
+// Options of Send/SyncSend for one message
+type SendOption func(*sendOptions)
+
+type sendOptions struct {
+	timeout  time.Duration
+	ctx      context.Context
+	priority int
+	noWait   bool
+	md       Metadata
+	// SyncSend only, see WithHedging
+	hedgeDelay time.Duration
+	hedgeKeys  []TransportKey
+}
+
+func newSendOptions(opts []SendOption) sendOptions {
+	so := sendOptions{
+		priority: PRIORITY_NORMAL,
+	}
+	for _, opt := range opts {
+		opt(&so)
+	}
+	return so
+}
+
+// The message times out after d, instead of the Timeout of the protocol
+func WithTimeout(d time.Duration) SendOption {
+	return func(so *sendOptions) {
+		so.timeout = d
+	}
+}
+
+// Bounds how long Send waits for room in the Queue, the default waits
+// as long as the Queue's overflow policy wants
+func WithContext(ctx context.Context) SendOption {
+	return func(so *sendOptions) {
+		so.ctx = ctx
+	}
+}
+
+// Send returns ErrQueueFull at once when there is no room in the Queue,
+// instead of waiting for it
+func WithNoWait() SendOption {
+	return func(so *sendOptions) {
+		so.noWait = true
+	}
+}
+
+// Priority of the message, lower is higher, it takes effect
+// when the Queue of the protocol implements PriorityPusher
+func WithPriority(priority int) SendOption {
+	return func(so *sendOptions) {
+		so.priority = priority
+	}
+}
+
+func (so *sendOptions) context() context.Context {
+	if so.ctx == nil {
+		return context.Background()
+	}
+	return so.ctx
+}
+
+// Optional interface of the message to set its own timeout,
+// WithTimeout takes precedence over it
+type MessageTimeouter interface {
+	MessageTimeout() time.Duration
+}
+
+// option first, then message, then protocol
+func (so *sendOptions) timeoutOf(msg interface{}, pt *protocolType) time.Duration {
+	if so.timeout > 0 {
+		return so.timeout
+	}
+
+	if mt, ok := msg.(MessageTimeouter); ok {
+		if d := mt.MessageTimeout(); d > 0 {
+			return d
+		}
+	}
+
+	if pt.Timeout != nil {
+		return pt.Timeout()
+	}
+	return DEFAULT_TIMEOUT * time.Second
+}
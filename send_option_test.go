@@ -0,0 +1,65 @@
+package listenrain
+
+import (
+	"testing"
+	"time"
+)
+
+type testTimeoutMessage struct {
+	d time.Duration
+}
+
+func (m testTimeoutMessage) MessageTimeout() time.Duration {
+	return m.d
+}
+
+func TestTimeoutOfPrecedence(t *testing.T) {
+	pt := &protocolType{Timeout: func() time.Duration { return time.Minute }}
+	msg := testTimeoutMessage{d: time.Second}
+
+	so := newSendOptions([]SendOption{WithTimeout(time.Millisecond)})
+	if d := so.timeoutOf(msg, pt); d != time.Millisecond {
+		t.Fatalf("WithTimeout takes precedence, got %s", d)
+	}
+
+	so = newSendOptions(nil)
+	if d := so.timeoutOf(msg, pt); d != time.Second {
+		t.Fatalf("MessageTimeouter takes precedence over the protocol, got %s", d)
+	}
+
+	if d := so.timeoutOf("plain", pt); d != time.Minute {
+		t.Fatalf("expect the timeout of the protocol, got %s", d)
+	}
+
+	if d := so.timeoutOf("plain", &protocolType{}); d != DEFAULT_TIMEOUT*time.Second {
+		t.Fatalf("expect DEFAULT_TIMEOUT, got %s", d)
+	}
+}
+
+func TestSendWithTimeout(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	// never responds
+	key := testServer(t, func(response ServerResponse, msgId string, cmd int, message interface{}) error {
+		return nil
+	}, nil)
+	ptyp := testClient(lr, nil)
+
+	start := time.Now()
+	sm := newTestStatMachine()
+	if err := lr.Send(ptyp, sm, key, "a:1", WithTimeout(200*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msgId := <-sm.timeouts:
+		if msgId != "a" {
+			t.Fatalf("unexpected msgId %s", msgId)
+		}
+	case <-time.After(testTimeout()):
+		t.Fatal("the timeout of the message is ignored")
+	}
+
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("timed out ahead of time, %s", elapsed)
+	}
+}
@@ -0,0 +1,92 @@
+package listenrain
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The request handed to the ServerHandler
+type ServerRequest struct {
+	// see ContextOf
+	Ctx context.Context
+	// Channel.PeerInfo of the connection
+	PeerInfo string
+	// the key the server listens on
+	TransportKey TransportKey
+	// when the packet of the request was decoded, before the wait for the executor
+	ReceivedAt time.Time
+	// nil if the protocol type is not Multiplex
+	Metadata Metadata
+	MsgId    string
+	Cmd      int
+	Message  interface{}
+}
+
+// The ServerRouter with the whole request, registered by RegisterServerProtocolV2
+type ServerHandler func(response ServerResponse, request *ServerRequest) error
+
+// The codes of the errors responded by the framework
+const (
+	// the router returned an error which is not a *RemoteError
+	ERROR_CODE_INTERNAL = -1
+	// the server failed to decode the request
+	ERROR_CODE_BAD_REQUEST = -2
+	// the request exceeded the RateLimit of the server
+	ERROR_CODE_OVERLOAD = -3
+)
+
+// The error status responded by ErrorResponse.ResponseError, or by the
+// framework when the router returns an error without responding. SyncSend
+// returns it as the error, the StatMachine receives it by ErrorStatMachine
+// or in place of the message. The router returns it to choose the code.
+type RemoteError struct {
+	Code    int
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error, code:%d, %s", e.Code, e.Message)
+}
+
+// Optional interface of the StatMachine to receive the *RemoteError,
+// ProcessError is called instead of Process
+type ErrorStatMachine interface {
+	StatMachine
+	ProcessError(msgId string, err *RemoteError)
+}
+
+func remoteErrorOf(err error) *RemoteError {
+	var rerr *RemoteError
+	if errors.As(err, &rerr) {
+		return rerr
+	}
+	return &RemoteError{Code: ERROR_CODE_INTERNAL, Message: err.Error()}
+}
+
+// format:
+//
+//	+-----------------------+-----------------+
+//	|         code          |     message     |
+//	+-----------------------+-----------------+
+//	| 4 byte (big endian)   |   left bytes    |
+//	+-----------------------+-----------------+
+func encodeRemoteError(code int, message string) []byte {
+	body := make([]byte, 4+len(message))
+	binary.BigEndian.PutUint32(body, uint32(int32(code)))
+	copy(body[4:], message)
+	return body
+}
+
+func decodeRemoteError(body []byte) (*RemoteError, error) {
+	if len(body) < 4 {
+		return nil, fmt.Errorf("%w, error body size:%d", ErrInvalidFrame, len(body))
+	}
+
+	return &RemoteError{
+		Code:    int(int32(binary.BigEndian.Uint32(body))),
+		Message: string(body[4:]),
+	}, nil
+}
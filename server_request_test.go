@@ -0,0 +1,235 @@
+package listenrain
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServerHandlerRequest(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	requests := make(chan *ServerRequest, 1)
+	key := testServer(t, nil, func(pt *protocolType) {
+		pt.ServerHandler = func(response ServerResponse, request *ServerRequest) error {
+			requests <- request
+			return response.Response(request.Message)
+		}
+	})
+	ptyp := testClient(lr, nil)
+
+	start := time.Now()
+	if _, err := lr.SyncSend(ptyp, key, "a:1"); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-requests
+	if r.MsgId != "a" || r.Message != "a:1" || r.TransportKey != TransportKey(key) || r.PeerInfo == "" || r.Ctx == nil {
+		t.Fatalf("unexpected request %+v", r)
+	}
+
+	if r.ReceivedAt.Before(start) || r.ReceivedAt.After(time.Now()) {
+		t.Fatalf("unexpected ReceivedAt %s", r.ReceivedAt)
+	}
+}
+
+// the wait for the busy executor is not counted in ReceivedAt
+func TestReceivedAtBeforeExecutorWait(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	mux := func(pt *protocolType) { pt.Multiplex = true }
+	waits := make(chan time.Duration, 2)
+	key := testServer(t, nil, func(pt *protocolType) {
+		mux(pt)
+		pt.ExecutorGenerator = func(TransportKey) (Executor, error) {
+			return NewWorkerPoolExecutor(1, 16, REJECTION_BLOCK), nil
+		}
+		pt.ServerHandler = func(response ServerResponse, request *ServerRequest) error {
+			waits <- time.Since(request.ReceivedAt)
+			time.Sleep(200 * time.Millisecond)
+			return response.Response(request.Message)
+		}
+	})
+	ptyp := testClient(lr, mux)
+
+	sm := newTestStatMachine()
+	for _, msg := range []string{"a:1", "b:2"} {
+		if err := lr.Send(ptyp, sm, key, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	<-waits
+	if wait := <-waits; wait < 150*time.Millisecond {
+		t.Fatalf("expect the second request waited for the first one, got %s", wait)
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	mux := func(pt *protocolType) { pt.Multiplex = true }
+	key := testServer(t, func(response ServerResponse, msgId string, cmd int, message interface{}) error {
+		return ResponseError(response, 42, "nope")
+	}, mux)
+	ptyp := testClient(lr, mux)
+
+	_, err := lr.SyncSend(ptyp, key, "a:1")
+	var rerr *RemoteError
+	if !errors.As(err, &rerr) || rerr.Code != 42 || rerr.Message != "nope" {
+		t.Fatalf("expect the remote error 42, got %v", err)
+	}
+}
+
+func TestResponseErrorRequiresMultiplex(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	key := testServer(t, func(response ServerResponse, msgId string, cmd int, message interface{}) error {
+		if _, ok := response.(ErrorResponse); ok {
+			return response.Response("unexpected:ErrorResponse")
+		}
+
+		if err := ResponseError(response, 42, "nope"); !errors.Is(err, ErrMultiplexRequired) {
+			return response.Response("unexpected:error")
+		}
+		return response.Response(message)
+	}, nil)
+	ptyp := testClient(lr, nil)
+
+	v, err := lr.SyncSend(ptyp, key, "a:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != "a:1" {
+		t.Fatalf("unexpected response %v", v)
+	}
+}
+
+func TestRemoteErrorRoundTrip(t *testing.T) {
+	rerr, err := decodeRemoteError(encodeRemoteError(ERROR_CODE_OVERLOAD, "busy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rerr.Code != ERROR_CODE_OVERLOAD || rerr.Message != "busy" {
+		t.Fatalf("unexpected remote error %+v", rerr)
+	}
+
+	if _, err := decodeRemoteError([]byte{1, 2}); !errors.Is(err, ErrInvalidFrame) {
+		t.Fatalf("expect ErrInvalidFrame, got %v", err)
+	}
+
+	if rerr := remoteErrorOf(errors.New("boom")); rerr.Code != ERROR_CODE_INTERNAL || rerr.Message != "boom" {
+		t.Fatalf("unexpected remote error %+v", rerr)
+	}
+}
+
+func testMultiplexResponse() (*multiplexResponse, *DefaultQueue) {
+	q := NewDefaultQueue(16)
+	t := &serverTransport{q: q, edM: testCodec{}, ctx: context.Background()}
+	return newMultiplexResponse(t, &frameHeader{kind: FRAME_REQUEST, reqId: 1, timeout: time.Minute}, time.Now()), q
+}
+
+func TestMultiplexResponseOnce(t *testing.T) {
+	r, q := testMultiplexResponse()
+	if err := r.Response("a:1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the router returning an error after responding
+	r.fail(errors.New("boom"))
+	if err := r.Response("a:2"); err != ErrResponded {
+		t.Fatalf("expect ErrResponded, got %v", err)
+	}
+
+	if len(q.q) != 1 {
+		t.Fatalf("expect one response, got %d", len(q.q))
+	}
+
+	if h, _, _ := decodeFrame(q.Pop()); h.kind != FRAME_RESPONSE {
+		t.Fatalf("expect the response frame, got kind:%d", h.kind)
+	}
+
+	if r.Context().Err() == nil {
+		t.Fatal("expect the context done once responded")
+	}
+}
+
+// the async response races with the framework failing the request
+func TestMultiplexResponseRace(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		r, q := testMultiplexResponse()
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			r.Response("a:1")
+		}()
+		go func() {
+			defer wg.Done()
+			r.fail(errors.New("boom"))
+		}()
+		wg.Wait()
+
+		if len(q.q) != 1 {
+			t.Fatalf("expect one response, got %d", len(q.q))
+		}
+	}
+}
+
+func TestRouterErrorResponded(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	mux := func(pt *protocolType) { pt.Multiplex = true }
+	key := testServer(t, func(response ServerResponse, msgId string, cmd int, message interface{}) error {
+		switch message {
+		case "remote:1":
+			return &RemoteError{Code: 7, Message: "seven"}
+		case "responded:1":
+			response.Response(message)
+			return errors.New("after the response")
+		}
+		return errors.New("boom")
+	}, mux)
+	ptyp := testClient(lr, mux)
+
+	cases := []struct {
+		msg  string
+		code int
+	}{
+		{"remote:1", 7},
+		{"plain:1", ERROR_CODE_INTERNAL},
+	}
+	for _, c := range cases {
+		_, err := lr.SyncSend(ptyp, key, c.msg)
+		var rerr *RemoteError
+		if !errors.As(err, &rerr) || rerr.Code != c.code {
+			t.Fatalf("%s, expect the remote error %d, got %v", c.msg, c.code, err)
+		}
+	}
+
+	v, err := lr.SyncSend(ptyp, key, "responded:1")
+	if err != nil || v != "responded:1" {
+		t.Fatalf("expect the response kept, got %v, %v", v, err)
+	}
+}
+
+// without Multiplex the error of the router is only logged
+func TestRouterErrorLoggedWithoutMultiplex(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	key := testServer(t, func(response ServerResponse, msgId string, cmd int, message interface{}) error {
+		return errors.New("boom")
+	}, nil)
+	ptyp := testClient(lr, nil)
+
+	sm := newTestStatMachine()
+	if err := lr.Send(ptyp, sm, key, "a:1", WithTimeout(100*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-sm.timeouts:
+	case v := <-sm.results:
+		t.Fatalf("unexpected response %v", v)
+	case <-time.After(testTimeout()):
+		t.Fatal("the request doesn't time out")
+	}
+}
@@ -1,9 +1,13 @@
 package listenrain
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type ServerResponse interface {
@@ -12,21 +16,71 @@ type ServerResponse interface {
 	Close()
 }
 
+// Implemented by the ServerResponse of the Multiplex protocol type
+type ErrorResponse interface {
+	ServerResponse
+	// Respond the error status instead of a message, the client receives a *RemoteError
+	ResponseError(code int, message string) error
+}
+
+// Respond the error status by the ErrorResponse, ErrMultiplexRequired if
+// the response doesn't implement it
+func ResponseError(response ServerResponse, code int, message string) error {
+	if er, ok := response.(ErrorResponse); ok {
+		return er.ResponseError(code, message)
+	}
+	return fmt.Errorf("response error, %w", ErrMultiplexRequired)
+}
+
+// Implemented by the ServerResponse of the default server transport
+type ContextResponse interface {
+	ServerResponse
+	// With the deadline of the client if the protocol type is Multiplex, done
+	// when the deadline passes, the connection closes or the router returns
+	Context() context.Context
+}
+
+// The context of the request, context.Background() if the response doesn't carry one
+func ContextOf(response ServerResponse) context.Context {
+	if cr, ok := response.(ContextResponse); ok {
+		return cr.Context()
+	}
+	return context.Background()
+}
+
 type CmdMethoder interface {
 	Cmd() int
 }
 
 type serverTransport struct {
-	ch       Channel
-	q        Queue
-	edP      EnDecPacket
-	edM      EnDecMessage
-	cg       ChannelGenerator
-	executor Executor
-	close    bool
-	err      error
-	wg       sync.WaitGroup
-	router   ServerRouter
+	// unix nano of the last packet received, first field for the 64-bit alignment of atomic
+	lastRead  int64
+	ch        Channel
+	q         Queue
+	edP       EnDecPacket
+	edM       EnDecMessage
+	cg        ChannelGenerator
+	executor  Executor
+	close     bool
+	err       error
+	wg        sync.WaitGroup
+	router    ServerRouter
+	handler   ServerHandler
+	key       TransportKey
+	multiplex bool
+	bw        *batchWriter
+	releaser  PacketBufferReleaser
+	pt        *protocolType
+	// size of the buffered reader of the channel
+	readBufferSize int
+	// done when the transport stops
+	ctx         context.Context
+	cancel      context.CancelFunc
+	rateLimit   *RateLimit
+	connLimiter Limiter
+	// the error shutdown closed the connection for, set from the reader and the executor
+	shutdownMu  sync.Mutex
+	shutdownErr error
 }
 
 func newServerTransport(ch Channel, transportKey TransportKey, pt *protocolType, cg ChannelGenerator) (*serverTransport, error) {
@@ -41,38 +95,85 @@ func newServerTransport(ch Channel, transportKey TransportKey, pt *protocolType,
 	}
 
 	transport := &serverTransport{
-		ch:       ch,
-		q:        q,
-		edP:      pt.EdP,
-		edM:      pt.EdM,
-		cg:       cg,
-		executor: exe,
-		router:   pt.ServerRouter,
+		ch:             ch,
+		q:              q,
+		edP:            pt.EdP,
+		edM:            pt.EdM,
+		cg:             cg,
+		executor:       exe,
+		router:         pt.ServerRouter,
+		handler:        pt.ServerHandler,
+		key:            transportKey,
+		multiplex:      pt.Multiplex,
+		bw:             newBatchWriter(pt, q),
+		readBufferSize: pt.ReadBufferSize,
+		pt:             pt,
 	}
 
+	if releaser, ok := pt.EdP.(PacketBufferReleaser); ok {
+		transport.releaser = releaser
+	}
+
+	if rl := pt.RateLimit; rl != nil {
+		transport.rateLimit = rl
+		if rl.PerConnection != nil {
+			transport.connLimiter = rl.PerConnection()
+		}
+	}
+
+	transport.ctx, transport.cancel = context.WithCancel(context.Background())
 	return transport, nil
 }
 
 // This logic is actually very similar to client transport, and can be unified in the follow-up
 func (t *serverTransport) runloop() error {
+	defer t.cancel()
+	if t.pt.IdleTimeout > 0 {
+		atomic.StoreInt64(&t.lastRead, time.Now().UnixNano())
+		go t.idleCheck()
+	}
+
 	t.wg.Add(2)
 	var closewg sync.WaitGroup
 	closewg.Add(1)
 	go func() {
 		// receive request from client
+		rd := newPacketReader(t.ch, t.readBufferSize)
 		for {
-			rcvPayload, err := t.edP.DecodePacket(t.ch)
+			rcvPayload, err := t.edP.DecodePacket(rd)
 			if t.close || t.err != nil {
 				break
 			}
 
 			if err != nil {
-				// TODO
-				t.err = err
+				if errors.Is(err, ErrProtocolViolation) {
+					atomic.AddUint64(&t.pt.violations, 1)
+				}
+				t.shutdown(err)
+				break
+			}
+
+			now := time.Now()
+			if t.pt.IdleTimeout > 0 {
+				atomic.StoreInt64(&t.lastRead, now.UnixNano())
+			}
+
+			if t.multiplex && isFrameKind(rcvPayload, FRAME_PING) {
+				t.pong(rcvPayload)
+				t.releasePacket(rcvPayload)
+				continue
+			}
+
+			// hold the reading of the connection until the limits allow
+			if err := t.delay(); err != nil {
+				t.releasePacket(rcvPayload)
+				if !t.close {
+					t.shutdown(err)
+				}
 				break
 			}
 
-			t.executor.Process(t, rcvPayload)
+			t.executor.Process(&receivedPacket{t: t, at: now}, rcvPayload)
 		}
 		t.wg.Done()
 		closewg.Done()
@@ -80,9 +181,19 @@ func (t *serverTransport) runloop() error {
 
 	for {
 		// deal with response from server
-		payload := t.q.Pop()
-		err := t.edP.EncodePacket(t.ch, payload)
-		if err != nil {
+		var err error
+		if t.bw != nil {
+			if t.bw.fill() > 0 {
+				err = t.bw.flush(t.ch)
+			}
+		} else {
+			payload := t.q.Pop()
+			err = dropUnencodable(t.edP.EncodePacket(t.ch, payload))
+		}
+		// keep the first error, which closed the connection
+		if serr := t.shutdownError(); serr != nil {
+			t.err = serr
+		} else if err != nil && t.err == nil {
 			t.err = err
 		}
 
@@ -110,24 +221,216 @@ func (t *serverTransport) runloop() error {
 	return t.err
 }
 
+// close the offending connection, and wake up the sender blocked on the queue
+func (t *serverTransport) shutdown(err error) {
+	t.shutdownMu.Lock()
+	if t.shutdownErr == nil {
+		t.shutdownErr = err
+	}
+	t.shutdownMu.Unlock()
+
+	t.cancel()
+	t.ch.Close()
+	t.q.TryPush(nil)
+}
+
+func (t *serverTransport) shutdownError() error {
+	t.shutdownMu.Lock()
+	defer t.shutdownMu.Unlock()
+	return t.shutdownErr
+}
+
+// the global and per connection limits of LIMIT_DELAY
+func (t *serverTransport) delay() error {
+	rl := t.rateLimit
+	if rl == nil || rl.Policy != LIMIT_DELAY {
+		return nil
+	}
+
+	if rl.Global != nil {
+		if err := rl.Global.Wait(t.ctx); err != nil {
+			return err
+		}
+	}
+
+	if t.connLimiter != nil {
+		return t.connLimiter.Wait(t.ctx)
+	}
+	return nil
+}
+
+// the limits left to the decoded request, return ErrRateLimited or the error of waiting
+func (t *serverTransport) limit(ctx context.Context, cmd int) error {
+	rl := t.rateLimit
+	if rl == nil {
+		return nil
+	}
+
+	if rl.Policy == LIMIT_DELAY {
+		if l := rl.PerCommand[cmd]; l != nil {
+			return l.Wait(ctx)
+		}
+		return nil
+	}
+
+	if rl.Global != nil && !rl.Global.Allow() {
+		return fmt.Errorf("global, %w", ErrRateLimited)
+	}
+
+	if t.connLimiter != nil && !t.connLimiter.Allow() {
+		return fmt.Errorf("connection, %w", ErrRateLimited)
+	}
+
+	if l := rl.PerCommand[cmd]; l != nil && !l.Allow() {
+		return fmt.Errorf("cmd:%d, %w", cmd, ErrRateLimited)
+	}
+	return nil
+}
+
+func (t *serverTransport) releasePacket(payload []byte) {
+	if t.releaser != nil && payload != nil {
+		t.releaser.ReleasePacket(payload)
+	}
+}
+
+// The runner of the packet received by the server transport, it keeps the
+// time the packet was decoded, so that ReceivedAt doesn't count the wait
+// for the executor
+type receivedPacket struct {
+	t  *serverTransport
+	at time.Time
+	// decoded ahead by the OrderedExecutor
+	req     decodedRequest
+	decoded bool
+}
+
+func (p *receivedPacket) Process(payload []byte) {
+	if !p.decoded {
+		p.req = p.t.decode(payload)
+	}
+	p.t.process(payload, p.at, &p.req)
+}
+
+// the PartitionKey of the message, or the connection
+func (p *receivedPacket) partitionKey(payload []byte) interface{} {
+	p.req, p.decoded = p.t.decode(payload), true
+	if pk, ok := p.req.v.(PartitionKeyer); ok {
+		return pk.PartitionKey()
+	}
+	return p.t
+}
+
 func (t *serverTransport) Process(payload []byte) {
-	v, msgId, err := t.edM.DecodeMessage(payload)
-	if err != nil {
+	req := t.decode(payload)
+	t.process(payload, time.Now(), &req)
+}
+
+// the request of a packet
+type decodedRequest struct {
+	h frameHeader
+	// the packet is not a request frame, it is dropped
+	frameErr error
+	v        interface{}
+	msgId    string
+	// the message can't be decoded
+	err error
+}
+
+func (t *serverTransport) decode(payload []byte) (req decodedRequest) {
+	if t.multiplex {
+		h, body, err := decodeFrame(payload)
+		if err == nil && h.kind != FRAME_REQUEST {
+			err = fmt.Errorf("reqId:%d unexpected frame kind:%d", h.reqId, h.kind)
+		}
+
+		if err != nil {
+			req.frameErr = err
+			return req
+		}
+		req.h, payload = h, body
+	}
+
+	req.v, req.msgId, req.err = t.edM.DecodeMessage(payload)
+	return req
+}
+
+func (t *serverTransport) process(payload []byte, receivedAt time.Time, req *decodedRequest) {
+	// the router must not reference the message after it returns
+	defer t.releasePacket(payload)
+
+	if req.frameErr != nil {
+		log.Printf("server transport from %s, %s", t.ch.PeerInfo(), req.frameErr)
+		return
+	}
+
+	var (
+		response ServerResponse = t
+		muxResp  *multiplexResponse
+		reqId    uint64
+		md       Metadata
+		v, msgId = req.v, req.msgId
+	)
+	if t.multiplex {
+		reqId, md = req.h.reqId, req.h.md
+		muxResp = newMultiplexResponse(t, &req.h, receivedAt)
+		defer muxResp.release()
+		response = muxResp
+	}
+
+	if err := req.err; err != nil {
 		log.Printf("server transport msgId:%s decode, %s", msgId, err)
+		if muxResp != nil {
+			muxResp.fail(&RemoteError{Code: ERROR_CODE_BAD_REQUEST, Message: err.Error()})
+		}
 		return
 	}
 
+	if t.multiplex {
+		msgId = formatReqId(reqId)
+	}
+
 	var cmdNo int = -19900405
-	if t.router == nil {
+	if t.router == nil && t.handler == nil {
 		log.Printf("server transport not register router function")
+		if muxResp != nil {
+			muxResp.fail(errors.New("not register router function"))
+		}
 		return
 	} else if cmd, ok := v.(CmdMethoder); ok {
 		cmdNo = cmd.Cmd()
 	}
 
-	err = t.router(t, msgId, cmdNo, v)
+	if err := t.limit(ContextOf(response), cmdNo); err != nil {
+		atomic.AddUint64(&t.pt.limited, 1)
+		log.Printf("server transport from %s msgId:%s, %s", t.ch.PeerInfo(), msgId, err)
+		if t.rateLimit.Policy == LIMIT_CLOSE {
+			t.shutdown(err)
+		} else if muxResp != nil {
+			muxResp.fail(&RemoteError{Code: ERROR_CODE_OVERLOAD, Message: err.Error()})
+		}
+		return
+	}
+
+	var err error
+	if t.handler != nil {
+		err = t.handler(response, &ServerRequest{
+			Ctx:          ContextOf(response),
+			PeerInfo:     t.ch.PeerInfo(),
+			TransportKey: t.key,
+			ReceivedAt:   receivedAt,
+			Metadata:     md,
+			MsgId:        msgId,
+			Cmd:          cmdNo,
+			Message:      v,
+		})
+	} else {
+		err = t.router(response, msgId, cmdNo, v)
+	}
 	if err != nil {
 		log.Printf("server transport router function, %s", err)
+		if muxResp != nil {
+			muxResp.fail(err)
+		}
 	}
 }
 
@@ -141,8 +444,11 @@ func (t *serverTransport) Response(message interface{}) error {
 		return err
 	}
 
-	t.q.Push(payload)
-	return nil
+	return t.q.PushContext(context.Background(), payload)
+}
+
+func (t *serverTransport) Context() context.Context {
+	return t.ctx
 }
 
 func (t *serverTransport) Close() {
@@ -151,6 +457,7 @@ func (t *serverTransport) Close() {
 	}
 
 	t.close = true
+	t.cancel()
 	t.wg.Wait()
 }
 
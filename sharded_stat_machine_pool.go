@@ -0,0 +1,119 @@
+package listenrain
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	DEFAULT_STAT_MACHINE_POOL_SHARDS = 1 << 5 // 32
+	MAX_STAT_MACHINE_POOL_SHARDS     = 1 << 10
+)
+
+var (
+	ErrStatMachinePoolFull = errors.New("stat machine pool is full")
+)
+
+type statMachineShard struct {
+	mtx sync.Mutex
+	c   map[string]StatMachine
+}
+
+// The msgId is hashed to one of the shards, each shard has its own lock,
+// so senders, the receive path and the timer rarely contend with each other.
+type ShardedStatMachinePool struct {
+	shards   []statMachineShard
+	mask     uint32
+	capacity int64 // <= 0 means unlimited
+	size     int64
+}
+
+// shards is rounded up to the power of 2, capacity <= 0 means unlimited
+func NewShardedStatMachinePool(shards, capacity int) *ShardedStatMachinePool {
+	if shards <= 0 {
+		shards = DEFAULT_STAT_MACHINE_POOL_SHARDS
+	} else if shards > MAX_STAT_MACHINE_POOL_SHARDS {
+		shards = MAX_STAT_MACHINE_POOL_SHARDS
+	}
+
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+
+	p := &ShardedStatMachinePool{
+		shards:   make([]statMachineShard, n),
+		mask:     uint32(n - 1),
+		capacity: int64(capacity),
+	}
+	for i := range p.shards {
+		p.shards[i].c = make(map[string]StatMachine)
+	}
+	return p
+}
+
+// fnv-1a, no allocation
+func (p *ShardedStatMachinePool) shard(msgId string) *statMachineShard {
+	var h uint32 = 2166136261
+	for i := 0; i < len(msgId); i++ {
+		h ^= uint32(msgId[i])
+		h *= 16777619
+	}
+	return &p.shards[h&p.mask]
+}
+
+// Put overwrites the in-flight msgId and ignores the capacity,
+// Transport prefers TryPut
+func (p *ShardedStatMachinePool) Put(msgId string, sm StatMachine) {
+	s := p.shard(msgId)
+	s.mtx.Lock()
+	if _, exist := s.c[msgId]; !exist {
+		atomic.AddInt64(&p.size, 1)
+	}
+	s.c[msgId] = sm
+	s.mtx.Unlock()
+}
+
+func (p *ShardedStatMachinePool) TryPut(msgId string, sm StatMachine) error {
+	s := p.shard(msgId)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, exist := s.c[msgId]; exist {
+		return ErrDuplicateMsgId
+	}
+
+	if atomic.AddInt64(&p.size, 1) > p.capacity && p.capacity > 0 {
+		atomic.AddInt64(&p.size, -1)
+		return ErrStatMachinePoolFull
+	}
+	s.c[msgId] = sm
+	return nil
+}
+
+func (p *ShardedStatMachinePool) Pop(msgId string) StatMachine {
+	s := p.shard(msgId)
+	s.mtx.Lock()
+	sm, exist := s.c[msgId]
+	if exist {
+		delete(s.c, msgId)
+		atomic.AddInt64(&p.size, -1)
+	}
+	s.mtx.Unlock()
+	return sm
+}
+
+// number of in-flight state machines, for metrics
+func (p *ShardedStatMachinePool) Len() int {
+	return int(atomic.LoadInt64(&p.size))
+}
+
+func NewShardedStatMachinePoolGenerator(shards, capacity int) func(TransportKey) (StatMachinePool, error) {
+	return func(key TransportKey) (StatMachinePool, error) {
+		return NewShardedStatMachinePool(shards, capacity), nil
+	}
+}
+
+func ShardedStatMachinePoolGenerator(key TransportKey) (StatMachinePool, error) {
+	return NewShardedStatMachinePool(DEFAULT_STAT_MACHINE_POOL_SHARDS, 0), nil
+}
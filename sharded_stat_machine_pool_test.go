@@ -0,0 +1,74 @@
+package listenrain
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestShardedStatMachinePoolShards(t *testing.T) {
+	if n := len(NewShardedStatMachinePool(5, 0).shards); n != 8 {
+		t.Fatalf("expect the shards rounded up to 8, got %d", n)
+	}
+
+	if n := len(NewShardedStatMachinePool(0, 0).shards); n != DEFAULT_STAT_MACHINE_POOL_SHARDS {
+		t.Fatalf("expect the default shards, got %d", n)
+	}
+}
+
+func TestShardedStatMachinePoolCapacity(t *testing.T) {
+	p := NewShardedStatMachinePool(4, 2)
+	sm := newTestStatMachine()
+	for _, id := range []string{"a", "b"} {
+		if err := p.TryPut(id, sm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := p.TryPut("c", sm); !errors.Is(err, ErrStatMachinePoolFull) {
+		t.Fatalf("expect ErrStatMachinePoolFull, got %v", err)
+	}
+
+	if err := p.TryPut("a", sm); !errors.Is(err, ErrDuplicateMsgId) {
+		t.Fatalf("expect ErrDuplicateMsgId, got %v", err)
+	}
+
+	p.Pop("a")
+	if err := p.TryPut("c", sm); err != nil {
+		t.Fatalf("room is freed by Pop, %v", err)
+	}
+
+	if p.Len() != 2 {
+		t.Fatalf("expect 2 in flight, got %d", p.Len())
+	}
+}
+
+func TestShardedStatMachinePoolConcurrent(t *testing.T) {
+	p := NewShardedStatMachinePool(8, 0)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				id := strconv.Itoa(g) + "-" + strconv.Itoa(i)
+				sm := newTestStatMachine()
+				if err := p.TryPut(id, sm); err != nil {
+					t.Error(err)
+					return
+				}
+
+				if p.Pop(id) != sm {
+					t.Errorf("msgId:%s popped another state machine", id)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if p.Len() != 0 {
+		t.Fatalf("expect empty pool, got %d", p.Len())
+	}
+}
@@ -13,6 +13,7 @@ const (
 	SSM_INIT SyncStatMachine_Type = iota
 	SSM_SUCC
 	SSM_TIMEOUT
+	SSM_ERROR
 )
 
 var (
@@ -25,16 +26,31 @@ type SyncStatMachine struct {
 	// and needs to be benchmarked to verify
 	sync.WaitGroup
 	v     interface{}
+	err   *RemoteError
 	s     SyncStatMachine_Type
 	start time.Time
 }
 
+// The state machine handing the message over to another goroutine, the
+// packet buffer is not released after Process
+type messageKeeper interface {
+	keepMessage()
+}
+
+func (ssm *SyncStatMachine) keepMessage() {}
+
 func (ssm *SyncStatMachine) Process(msgId string, v interface{}) {
 	ssm.v = v
 	ssm.s = SSM_SUCC
 	ssm.Done()
 }
 
+func (ssm *SyncStatMachine) ProcessError(msgId string, err *RemoteError) {
+	ssm.err = err
+	ssm.s = SSM_ERROR
+	ssm.Done()
+}
+
 func (ssm *SyncStatMachine) Timeout(msgId string) {
 	log.Printf("timeout msgId:%s begin:%s", msgId, ssm.start.String())
 	ssm.s = SSM_TIMEOUT
@@ -59,11 +75,14 @@ func (ssm *SyncStatMachine) Return() (v interface{}, err error) {
 		v, err = ssm.v, nil
 	case SSM_TIMEOUT:
 		v, err = nil, SSM_TIMEOUT_ERROR
+	case SSM_ERROR:
+		v, err = nil, ssm.err
 	default:
 		return nil, errors.New("sync state machine is invalid stat")
 	}
 
 	ssm.v = nil
+	ssm.err = nil
 	ssm.s = SSM_INIT
 	return
 }
@@ -5,7 +5,21 @@ import (
 	"time"
 )
 
+// Hierarchical timing wheel, insert and cancel are O(1), entries in the
+// higher levels are cascaded into the lower levels when the lower level
+// wraps around, like the timer wheel of the linux kernel.
 const (
+	TIMER_TICK         = 100 * time.Millisecond
+	TIMER_WHEEL_BITS   = 6
+	TIMER_WHEEL_SIZE   = 1 << TIMER_WHEEL_BITS // 64 slots per level
+	TIMER_WHEEL_MASK   = TIMER_WHEEL_SIZE - 1
+	TIMER_WHEEL_LEVELS = 4 // 64^4 ticks, about 19 days with 100ms tick
+	TIMER_MAX_TICKS    = 1<<(TIMER_WHEEL_BITS*TIMER_WHEEL_LEVELS) - 1
+)
+
+const (
+	// Deprecated: the timing wheel doesn't queue the entries, it is
+	// unused and only kept for the compatibility
 	TENT_QSIZE = 16
 )
 
@@ -21,54 +35,169 @@ func init() {
 	}
 }
 
+// msgId indexes the entry, unless the protocol is multiplexed, then reqId does
+type timerKey struct {
+	msgId string
+	reqId uint64
+}
+
 type tentry struct {
-	msgId   string
-	timeout time.Time
+	key        timerKey
+	expire     uint64 // tick
+	prev, next *tentry
 }
 
-type timer struct {
-	c map[int]*tentry
+// slot is a circular doubly linked list with a sentinel head
+type tslot struct {
+	head tentry
+}
+
+func (s *tslot) init() {
+	s.head.prev = &s.head
+	s.head.next = &s.head
+}
+
+func (s *tslot) push(e *tentry) {
+	e.prev = s.head.prev
+	e.next = &s.head
+	s.head.prev.next = e
+	s.head.prev = e
 }
 
-func (t *timer) Top() interface{} {
-	if len(t.c) == 0 {
+// take all entries away, return the first one
+func (s *tslot) take() *tentry {
+	if s.head.next == &s.head {
 		return nil
 	}
+	first := s.head.next
+	s.head.prev.next = nil
+	s.init()
+	return first
+}
 
-	return t.c[0]
+func (e *tentry) unlink() {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	e.prev, e.next = nil, nil
 }
 
-func (t *timer) Push(x interface{}) {
-	idx := len(t.c)
-	t.c[idx] = x.(*tentry)
+type timer struct {
+	mtx    sync.Mutex
+	start  time.Time
+	now    uint64 // current tick
+	levels [TIMER_WHEEL_LEVELS][TIMER_WHEEL_SIZE]tslot
+	c      map[timerKey]*tentry
 }
 
-func (t *timer) Pop() interface{} {
-	e := t.c[len(t.c)-1]
-	if e == nil {
-		return nil
+func NewTimer() *timer {
+	t := &timer{
+		start: time.Now(),
+		c:     make(map[timerKey]*tentry),
 	}
-	delete(t.c, len(t.c)-1)
-	return e
+
+	for l := range t.levels {
+		for i := range t.levels[l] {
+			t.levels[l][i].init()
+		}
+	}
+	return t
 }
 
-func (t *timer) Len() int {
-	return len(t.c)
+func (t *timer) place(e *tentry) {
+	if e.expire < t.now {
+		e.expire = t.now
+	}
+
+	delta := e.expire - t.now
+	if delta > TIMER_MAX_TICKS {
+		delta = TIMER_MAX_TICKS
+		e.expire = t.now + delta
+	}
+
+	level := 0
+	for delta >= 1<<(uint(level+1)*TIMER_WHEEL_BITS) {
+		level++
+	}
+
+	idx := (e.expire >> (uint(level) * TIMER_WHEEL_BITS)) & TIMER_WHEEL_MASK
+	t.levels[level][idx].push(e)
 }
 
-func (t *timer) Less(i, j int) bool {
-	return t.c[i].timeout.Before(t.c[j].timeout)
+// Add the key expires after d, it replaces the existing entry of the same key
+func (t *timer) Add(key timerKey, d time.Duration) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	e, exist := t.c[key]
+	if exist {
+		e.unlink()
+	} else {
+		e = timeEntPool.Get().(*tentry)
+		e.key = key
+		t.c[key] = e
+	}
+
+	// round up, never expire ahead of time
+	e.expire = uint64((time.Since(t.start) + d + TIMER_TICK - 1) / TIMER_TICK)
+	if e.expire <= t.now {
+		e.expire = t.now + 1
+	}
+	t.place(e)
 }
 
-func (t *timer) Swap(i, j int) {
-	if i < 0 || j < 0 {
-		return
+// Cancel the key, when the response arrives
+func (t *timer) Cancel(key timerKey) {
+	t.mtx.Lock()
+	e, exist := t.c[key]
+	if exist {
+		delete(t.c, key)
+		e.unlink()
+		e.key = timerKey{}
+		timeEntPool.Put(e)
 	}
-	t.c[i], t.c[j] = t.c[j], t.c[i]
+	t.mtx.Unlock()
 }
 
-func NewTimer() *timer {
-	return &timer{
-		c: make(map[int]*tentry),
+func (t *timer) Len() int {
+	t.mtx.Lock()
+	n := len(t.c)
+	t.mtx.Unlock()
+	return n
+}
+
+// Expire advances the wheel to now and appends the expired keys to expired
+func (t *timer) Expire(now time.Time, expired []timerKey) []timerKey {
+	target := uint64(now.Sub(t.start) / TIMER_TICK)
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	for t.now < target {
+		t.now++
+		t.cascade()
+
+		for e := t.levels[0][t.now&TIMER_WHEEL_MASK].take(); e != nil; {
+			next := e.next
+			delete(t.c, e.key)
+			expired = append(expired, e.key)
+			e.prev, e.next = nil, nil
+			e.key = timerKey{}
+			timeEntPool.Put(e)
+			e = next
+		}
+	}
+	return expired
+}
+
+// move the entries of the higher level slot down, when the lower level wraps around
+func (t *timer) cascade() {
+	for level := 1; level < TIMER_WHEEL_LEVELS; level++ {
+		if (t.now>>(uint(level-1)*TIMER_WHEEL_BITS))&TIMER_WHEEL_MASK != 0 {
+			return
+		}
+
+		idx := (t.now >> (uint(level) * TIMER_WHEEL_BITS)) & TIMER_WHEEL_MASK
+		for e := t.levels[level][idx].take(); e != nil; {
+			next := e.next
+			t.place(e)
+			e = next
+		}
 	}
 }
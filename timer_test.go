@@ -0,0 +1,89 @@
+package listenrain
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimerExpire(t *testing.T) {
+	tm := NewTimer()
+	key := timerKey{msgId: "a"}
+	tm.Add(key, 3*TIMER_TICK)
+
+	if expired := tm.Expire(tm.start.Add(2*TIMER_TICK), nil); len(expired) != 0 {
+		t.Fatalf("expired ahead of time, %v", expired)
+	}
+
+	expired := tm.Expire(tm.start.Add(5*TIMER_TICK), nil)
+	if len(expired) != 1 || expired[0] != key {
+		t.Fatalf("expect %v expired, got %v", key, expired)
+	}
+
+	if tm.Len() != 0 {
+		t.Fatalf("expect empty timer, got %d", tm.Len())
+	}
+}
+
+func TestTimerCancel(t *testing.T) {
+	tm := NewTimer()
+	tm.Add(timerKey{reqId: 1}, TIMER_TICK)
+	tm.Add(timerKey{reqId: 2}, TIMER_TICK)
+	tm.Cancel(timerKey{reqId: 1})
+
+	if tm.Len() != 1 {
+		t.Fatalf("expect 1 entry, got %d", tm.Len())
+	}
+
+	expired := tm.Expire(tm.start.Add(3*TIMER_TICK), nil)
+	if len(expired) != 1 || expired[0].reqId != 2 {
+		t.Fatalf("expect only reqId 2 expired, got %v", expired)
+	}
+}
+
+// the entries of the higher levels are cascaded down and expire on time
+func TestTimerCascade(t *testing.T) {
+	tm := NewTimer()
+	ticks := []uint64{
+		TIMER_WHEEL_SIZE + 5,
+		TIMER_WHEEL_SIZE*TIMER_WHEEL_SIZE + 17,
+		3*TIMER_WHEEL_SIZE*TIMER_WHEEL_SIZE + 1,
+	}
+	for i, tick := range ticks {
+		tm.Add(timerKey{reqId: uint64(i)}, time.Duration(tick)*TIMER_TICK)
+	}
+
+	var now uint64
+	for i, tick := range ticks {
+		// the entry is placed at the tick or the next one, as the time passed rounds up
+		expired := tm.Expire(tm.start.Add(time.Duration(tick-1)*TIMER_TICK), nil)
+		if len(expired) != 0 {
+			t.Fatalf("tick:%d, expired ahead of time, %v", tick, expired)
+		}
+
+		expired = tm.Expire(tm.start.Add(time.Duration(tick+1)*TIMER_TICK), nil)
+		if len(expired) != 1 || expired[0].reqId != uint64(i) {
+			t.Fatalf("tick:%d, expect reqId %d expired, got %v", tick, i, expired)
+		}
+		now = tick
+	}
+
+	if tm.now != now+1 || tm.Len() != 0 {
+		t.Fatalf("unexpected timer state, now:%d, len:%d", tm.now, tm.Len())
+	}
+}
+
+// Add of the same key replaces the deadline
+func TestTimerReAdd(t *testing.T) {
+	tm := NewTimer()
+	key := timerKey{msgId: "a"}
+	tm.Add(key, TIMER_TICK)
+	tm.Add(key, 10*TIMER_TICK)
+
+	if expired := tm.Expire(tm.start.Add(5*TIMER_TICK), nil); len(expired) != 0 {
+		t.Fatalf("the first deadline is not replaced, %v", expired)
+	}
+
+	if expired := tm.Expire(tm.start.Add(12*TIMER_TICK), nil); len(expired) != 1 {
+		t.Fatalf("expect 1 expired, got %v", expired)
+	}
+}
@@ -0,0 +1,49 @@
+// The framing with an uvarint length prefix, small packets only
+// cost one byte of header.
+package listenrain
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+type UvarintEnDecPacket struct {
+	PacketOptions
+}
+
+func (ed *UvarintEnDecPacket) EncodePacket(w io.Writer, payload []byte) error {
+	if err := ed.checkSize(uint64(len(payload))); err != nil {
+		return err
+	}
+
+	var head [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(head[:], uint64(len(payload)))
+	err := writeFull(w, head[:n])
+	if err != nil {
+		return err
+	}
+	return writeFull(w, payload)
+}
+
+func (ed *UvarintEnDecPacket) AppendPacket(bufs net.Buffers, payload []byte) (net.Buffers, error) {
+	if err := ed.checkSize(uint64(len(payload))); err != nil {
+		return bufs, err
+	}
+
+	head := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(head, uint64(len(payload)))
+	return append(bufs, head[:n], payload), nil
+}
+
+func (ed *UvarintEnDecPacket) DecodePacket(r io.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(asByteReader(r))
+	if err != nil {
+		return nil, err
+	}
+
+	if size == 0 {
+		return nil, nil
+	}
+	return ed.readBody(r, size)
+}
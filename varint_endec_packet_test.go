@@ -0,0 +1,45 @@
+package listenrain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestUvarintEnDecPacketRoundTrip(t *testing.T) {
+	edp := &UvarintEnDecPacket{}
+	payloads := [][]byte{[]byte("a"), make([]byte, 300)}
+	var buf bytes.Buffer
+	for _, p := range payloads {
+		if err := edp.EncodePacket(&buf, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 1 and 2 bytes of header
+	if buf.Len() != 1+1+2+300 {
+		t.Fatalf("unexpected size %d", buf.Len())
+	}
+
+	for _, expect := range payloads {
+		p, err := edp.DecodePacket(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(p, expect) {
+			t.Fatalf("unexpected payload of %d bytes", len(p))
+		}
+	}
+}
+
+func TestUvarintEnDecPacketMaxSize(t *testing.T) {
+	edp := &UvarintEnDecPacket{PacketOptions: PacketOptions{MaxPacketSize: 4}}
+	if err := edp.CheckPacket(make([]byte, 5)); !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatalf("expect ErrPacketTooLarge, got %v", err)
+	}
+
+	if _, err := edp.DecodePacket(bytes.NewReader([]byte{5})); !errors.Is(err, ErrProtocolViolation) {
+		t.Fatalf("expect ErrProtocolViolation, got %v", err)
+	}
+}
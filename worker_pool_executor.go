@@ -0,0 +1,177 @@
+package listenrain
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_EXECUTOR_WORKERS      = 64
+	DEFAULT_EXECUTOR_BACKLOG      = 1 << 10 // 1024
+	DEFAULT_EXECUTOR_IDLE_TIMEOUT = 60 * time.Second
+)
+
+// What to do when the backlog of the WorkerPoolExecutor is full
+type RejectionPolicy uint8
+
+const (
+	// wait for room in the backlog, the receive loop stops reading the peer
+	REJECTION_BLOCK RejectionPolicy = iota
+	// run the task in the goroutine of the caller, the receive loop
+	REJECTION_CALLER_RUNS
+	// drop the received packet, the request times out; a timeout is never
+	// dropped, it runs in the goroutine of the caller
+	REJECTION_DROP
+)
+
+type executorTask struct {
+	pr      processRunner
+	payload []byte
+	tr      timeoutRunner
+	msgId   string
+}
+
+func (task *executorTask) run() {
+	if task.pr != nil {
+		task.pr.Process(task.payload)
+	} else {
+		task.tr.Timeout(task.msgId)
+	}
+}
+
+// A fixed number of workers serve a bounded backlog, so a burst of
+// packets costs the backlog rather than a goroutine each. The workers are
+// started on demand and exit after being idle for a while, so a pool per
+// transport doesn't outlive its transport.
+type WorkerPoolExecutor struct {
+	rejected uint64 // first field for the 64-bit alignment of atomic
+	workers  int32
+	size     int32
+	tasks    chan executorTask
+	policy   RejectionPolicy
+}
+
+// workers <= 0 means DEFAULT_EXECUTOR_WORKERS, backlog <= 0 means DEFAULT_EXECUTOR_BACKLOG
+func NewWorkerPoolExecutor(workers, backlog int, policy RejectionPolicy) *WorkerPoolExecutor {
+	if workers <= 0 {
+		workers = DEFAULT_EXECUTOR_WORKERS
+	}
+
+	if backlog <= 0 {
+		backlog = DEFAULT_EXECUTOR_BACKLOG
+	}
+
+	return &WorkerPoolExecutor{
+		size:   int32(workers),
+		tasks:  make(chan executorTask, backlog),
+		policy: policy,
+	}
+}
+
+func (e *WorkerPoolExecutor) Process(r processRunner, payload []byte) {
+	e.submit(executorTask{pr: r, payload: payload})
+}
+
+func (e *WorkerPoolExecutor) Timeout(r timeoutRunner, msgId string) {
+	e.submit(executorTask{tr: r, msgId: msgId})
+}
+
+func (e *WorkerPoolExecutor) submit(task executorTask) {
+	select {
+	case e.tasks <- task:
+		e.spawn()
+		return
+	default:
+	}
+
+	// the backlog is full
+	switch e.policy {
+	case REJECTION_BLOCK:
+		e.spawn()
+		e.tasks <- task
+		e.spawn()
+	case REJECTION_DROP:
+		if task.pr != nil {
+			atomic.AddUint64(&e.rejected, 1)
+			log.Printf("worker pool executor backlog is full, drop the packet")
+			return
+		}
+		fallthrough
+	default:
+		atomic.AddUint64(&e.rejected, 1)
+		task.run()
+	}
+}
+
+// start one more worker until the pool is full, the idle ones exit by themselves
+func (e *WorkerPoolExecutor) spawn() {
+	for {
+		n := atomic.LoadInt32(&e.workers)
+		if n >= e.size {
+			return
+		}
+
+		if atomic.CompareAndSwapInt32(&e.workers, n, n+1) {
+			go e.work()
+			return
+		}
+	}
+}
+
+func (e *WorkerPoolExecutor) work() {
+	idle := time.NewTimer(DEFAULT_EXECUTOR_IDLE_TIMEOUT)
+	defer idle.Stop()
+	for {
+		select {
+		case task := <-e.tasks:
+			task.run()
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(DEFAULT_EXECUTOR_IDLE_TIMEOUT)
+		case <-idle.C:
+			atomic.AddInt32(&e.workers, -1)
+			// the task queued while exiting would wait for the next one
+			if len(e.tasks) > 0 {
+				e.spawn()
+			}
+			return
+		}
+	}
+}
+
+// number of the tasks waiting for a worker, for metrics
+func (e *WorkerPoolExecutor) Len() int {
+	return len(e.tasks)
+}
+
+// number of the running workers, for metrics
+func (e *WorkerPoolExecutor) Workers() int {
+	return int(atomic.LoadInt32(&e.workers))
+}
+
+// number of the tasks which didn't fit in the backlog, for metrics
+func (e *WorkerPoolExecutor) Rejected() uint64 {
+	return atomic.LoadUint64(&e.rejected)
+}
+
+// every transport has its own pool of workers
+func NewWorkerPoolExecutorGenerator(workers, backlog int, policy RejectionPolicy) func(TransportKey) (Executor, error) {
+	return func(key TransportKey) (Executor, error) {
+		return NewWorkerPoolExecutor(workers, backlog, policy), nil
+	}
+}
+
+// all the transports of the generator share one pool of workers, to
+// bound the goroutines of the whole process
+func NewSharedWorkerPoolExecutorGenerator(workers, backlog int, policy RejectionPolicy) func(TransportKey) (Executor, error) {
+	e := NewWorkerPoolExecutor(workers, backlog, policy)
+	return func(key TransportKey) (Executor, error) {
+		return e, nil
+	}
+}
+
+func WorkerPoolExecutorGenerator(key TransportKey) (Executor, error) {
+	return NewWorkerPoolExecutor(DEFAULT_EXECUTOR_WORKERS, DEFAULT_EXECUTOR_BACKLOG, REJECTION_BLOCK), nil
+}
@@ -0,0 +1,167 @@
+package listenrain
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blocks the worker until release is closed
+type testRunner struct {
+	release chan struct{}
+	ran     int32
+}
+
+func newTestRunner() *testRunner {
+	return &testRunner{release: make(chan struct{})}
+}
+
+func (r *testRunner) Process(payload []byte) {
+	if len(payload) > 0 {
+		<-r.release
+	}
+	atomic.AddInt32(&r.ran, 1)
+}
+
+func (r *testRunner) Timeout(msgId string) {
+	atomic.AddInt32(&r.ran, 1)
+}
+
+func (r *testRunner) wait(t *testing.T, n int32) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout())
+	for atomic.LoadInt32(&r.ran) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %d tasks run, got %d", n, atomic.LoadInt32(&r.ran))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// the blocking tasks fill the workers, then the backlog
+func testFillWorkerPool(t *testing.T, e *WorkerPoolExecutor, r *testRunner, workers, backlog int) {
+	t.Helper()
+	for i := 0; i < workers; i++ {
+		e.Process(r, []byte("block"))
+	}
+
+	deadline := time.Now().Add(testTimeout())
+	for e.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the workers don't take the tasks")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < backlog; i++ {
+		e.Process(r, []byte("block"))
+	}
+}
+
+func TestWorkerPoolBoundedWorkers(t *testing.T) {
+	e := NewWorkerPoolExecutor(2, 8, REJECTION_BLOCK)
+	r := newTestRunner()
+	testFillWorkerPool(t, e, r, 2, 4)
+	if e.Workers() != 2 || e.Len() != 4 {
+		t.Fatalf("expect 2 workers and 4 waiting, got %d and %d", e.Workers(), e.Len())
+	}
+
+	close(r.release)
+	r.wait(t, 6)
+}
+
+func TestWorkerPoolRejectionDrop(t *testing.T) {
+	e := NewWorkerPoolExecutor(1, 1, REJECTION_DROP)
+	r := newTestRunner()
+	testFillWorkerPool(t, e, r, 1, 1)
+
+	e.Process(r, []byte("dropped"))
+	if e.Rejected() != 1 {
+		t.Fatalf("expect 1 rejected, got %d", e.Rejected())
+	}
+
+	// the timeout is never dropped, it runs in the caller
+	e.Timeout(r, "a")
+	if atomic.LoadInt32(&r.ran) != 1 || e.Rejected() != 2 {
+		t.Fatalf("expect the timeout run by the caller, ran:%d", atomic.LoadInt32(&r.ran))
+	}
+
+	close(r.release)
+	r.wait(t, 3)
+}
+
+func TestWorkerPoolRejectionCallerRuns(t *testing.T) {
+	e := NewWorkerPoolExecutor(1, 1, REJECTION_CALLER_RUNS)
+	r := newTestRunner()
+	testFillWorkerPool(t, e, r, 1, 1)
+
+	// run before Process returns
+	e.Process(r, nil)
+	if atomic.LoadInt32(&r.ran) != 1 || e.Rejected() != 1 {
+		t.Fatalf("expect the task run by the caller, ran:%d", atomic.LoadInt32(&r.ran))
+	}
+
+	close(r.release)
+	r.wait(t, 3)
+}
+
+func TestWorkerPoolRejectionBlock(t *testing.T) {
+	e := NewWorkerPoolExecutor(1, 1, REJECTION_BLOCK)
+	r := newTestRunner()
+	testFillWorkerPool(t, e, r, 1, 1)
+
+	done := make(chan struct{})
+	go func() {
+		e.Process(r, nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Process doesn't wait for room in the backlog")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(r.release)
+	<-done
+	r.wait(t, 3)
+}
+
+func TestWorkerPoolExecutorGenerators(t *testing.T) {
+	shared := NewSharedWorkerPoolExecutorGenerator(1, 1, REJECTION_BLOCK)
+	a, _ := shared(nil)
+	b, _ := shared(nil)
+	if a != b {
+		t.Fatal("expect one shared pool")
+	}
+
+	gen := NewWorkerPoolExecutorGenerator(1, 1, REJECTION_BLOCK)
+	a, _ = gen(nil)
+	b, _ = gen(nil)
+	if a == b {
+		t.Fatal("expect a pool per transport")
+	}
+
+	e := NewWorkerPoolExecutor(0, 0, REJECTION_BLOCK)
+	if e.size != DEFAULT_EXECUTOR_WORKERS || cap(e.tasks) != DEFAULT_EXECUTOR_BACKLOG {
+		t.Fatalf("unexpected defaults, workers:%d, backlog:%d", e.size, cap(e.tasks))
+	}
+}
+
+func TestWorkerPoolSendEcho(t *testing.T) {
+	lr := NewListenRain(NewDefaultTransportPool())
+	pool := func(pt *protocolType) {
+		pt.ExecutorGenerator = NewSharedWorkerPoolExecutorGenerator(4, 16, REJECTION_BLOCK)
+	}
+	key := testServer(t, testEchoRouter, pool)
+	ptyp := testClient(lr, pool)
+
+	v, err := lr.SyncSend(ptyp, key, "a:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != "a:1" {
+		t.Fatalf("unexpected response %v", v)
+	}
+}